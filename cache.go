@@ -0,0 +1,145 @@
+package fet
+
+import (
+	"context"
+	"html/template"
+	"io/fs"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fefit/fet/lib/funcs"
+)
+
+// StatFn for cache files
+type StatFn func(file string) (fs.FileInfo, error)
+
+// cacheItem for parsed template
+type cacheItem struct {
+	// the unix nanoseconds of the last time the files are checked, keep it first for the atomic operations
+	checked int64
+	tmpl    *template.Template
+	// the unexecuted template, html/template can't be cloned after executed
+	master *template.Template
+	// the first include tag of each nested depth
+	includes []includeTag
+	files    map[string]time.Time
+	stat     StatFn
+	// the copies of the template bound to a changeable ctx, reused by the executions with a ctx
+	bounds sync.Pool
+}
+
+// boundTemplate is a copy of the template which funcs read the ctx of the current execution
+type boundTemplate struct {
+	tmpl *template.Template
+	ctx  context.Context
+}
+
+// get a copy of the template with the funcs bound to the ctx, it should be released after the execution,
+// the copy is cloned only if there is no released one, so the template is not cloned and escaped every time
+func (item *cacheItem) bind(ctx context.Context, fns template.FuncMap) (*boundTemplate, error) {
+	bound, _ := item.bounds.Get().(*boundTemplate)
+	if bound == nil {
+		t, err := item.master.Clone()
+		if err != nil {
+			return nil, err
+		}
+		bound = &boundTemplate{}
+		bound.tmpl = t.Funcs(funcs.WithContextFunc(func() context.Context {
+			return bound.ctx
+		}, fns))
+	}
+	bound.ctx = ctx
+	return bound, nil
+}
+
+// release the bound copy after the execution
+func (item *cacheItem) release(bound *boundTemplate) {
+	bound.ctx = nil
+	item.bounds.Put(bound)
+}
+
+// templateCache keep the parsed templates
+type templateCache struct {
+	sync.RWMutex
+	items map[string]*cacheItem
+	// the interval to check the modify time of the files, 0 means every time, negative means never
+	checkInterval time.Duration
+}
+
+func newTemplateCache(checkInterval time.Duration) *templateCache {
+	return &templateCache{
+		items:         map[string]*cacheItem{},
+		checkInterval: checkInterval,
+	}
+}
+
+// get the cached template, if any file it depends has been changed, return false
+func (cache *templateCache) get(key string) (*cacheItem, bool) {
+	cache.RLock()
+	item, ok := cache.items[key]
+	if !ok {
+		cache.RUnlock()
+		return nil, false
+	}
+	now := time.Now().UnixNano()
+	if cache.checkInterval < 0 || (cache.checkInterval > 0 && now-atomic.LoadInt64(&item.checked) < int64(cache.checkInterval)) {
+		cache.RUnlock()
+		return item, true
+	}
+	// the item can't be replaced while the files are checked
+	changed := false
+	for file, modTime := range item.files {
+		if info, err := item.stat(file); err != nil || !info.ModTime().Equal(modTime) {
+			changed = true
+			break
+		}
+	}
+	cache.RUnlock()
+	if changed {
+		cache.Lock()
+		// don't remove the template set by others after the check
+		if cache.items[key] == item {
+			delete(cache.items, key)
+		}
+		cache.Unlock()
+		return nil, false
+	}
+	atomic.StoreInt64(&item.checked, now)
+	return item, true
+}
+
+// set the parsed template with the files it depends, the template must not be executed
+func (cache *templateCache) set(key string, master *template.Template, includes []includeTag, files []string, stat StatFn) (*cacheItem, error) {
+	tmpl, err := master.Clone()
+	if err != nil {
+		return nil, err
+	}
+	item := &cacheItem{
+		tmpl:     tmpl,
+		master:   master,
+		includes: includes,
+		files:    map[string]time.Time{},
+		stat:     stat,
+		checked:  time.Now().UnixNano(),
+	}
+	for _, file := range files {
+		info, err := stat(file)
+		if err != nil {
+			// can't check the file, don't cache it
+			return item, nil
+		}
+		item.files[file] = info.ModTime()
+	}
+	cache.Lock()
+	cache.items[key] = item
+	cache.Unlock()
+	return item, nil
+}
+
+// clear all the cached templates
+func (cache *templateCache) clear() {
+	cache.Lock()
+	cache.items = map[string]*cacheItem{}
+	cache.Unlock()
+}
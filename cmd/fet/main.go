@@ -0,0 +1,240 @@
+// Command fet compile, check and render the fet templates.
+//
+// Usage:
+//
+//	fet [-config fet.json] <command> [arguments]
+//
+// The commands are:
+//
+//	compile [files]              compile the files, or all the files of the template directory
+//	check [files]                check the files without writing the compiled files
+//	render [-data file] <file>   render the template with the json data of the file or stdin
+//	deps [files]                 print the extends and include files of the templates
+//	watch                        compile all the files and recompile them when changed
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sort"
+
+	"github.com/fefit/fet"
+)
+
+const usage = `Usage: fet [-config fet.json] <command> [arguments]
+
+Commands:
+  compile [files]              compile the files, or all the files of the template directory
+  check [files]                check the files without writing the compiled files
+  render [-data file] <file>   render the template with the json data of the file or stdin
+  deps [files]                 print the extends and include files of the templates
+  watch                        compile all the files and recompile them when changed
+`
+
+// the exit codes
+const (
+	exitOk = iota
+	exitFail
+	exitUsage
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// cli holds the fet instance and the io of the command
+type cli struct {
+	fet    *fet.Fet
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("fet", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, usage)
+	}
+	confFile := flags.String("config", "", "the json config file")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+	conf := &fet.Config{}
+	if *confFile != "" {
+		var err error
+		if conf, err = fet.LoadConf(*confFile); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitFail
+		}
+	}
+	instance, err := fet.New(conf)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFail
+	}
+	c := &cli{
+		fet:    instance,
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+	command, cmdArgs := flags.Arg(0), flags.Args()[1:]
+	switch command {
+	case "compile":
+		err = c.compile(cmdArgs, true)
+	case "check":
+		err = c.compile(cmdArgs, false)
+	case "render":
+		err = c.render(cmdArgs)
+	case "deps":
+		err = c.deps(cmdArgs)
+	case "watch":
+		err = c.watch()
+	default:
+		fmt.Fprintf(stderr, "unknown command '%s'\n", command)
+		flags.Usage()
+		return exitUsage
+	}
+	if err != nil {
+		if !errors.Is(err, errReported) {
+			fmt.Fprintln(stderr, err)
+		}
+		return exitFail
+	}
+	return exitOk
+}
+
+// the errors have been written to stderr
+var errReported = errors.New("fet: errors reported")
+
+// the template files of the arguments, all the files of the template directory if no arguments
+func (c *cli) files(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return c.fet.GetCompileFiles(c.fet.TemplateDir)
+	}
+	files := []string{}
+	for _, tpl := range args {
+		files = append(files, c.fet.RealTmplPath(tpl))
+	}
+	return files, nil
+}
+
+// compile or check the files
+func (c *cli) compile(args []string, writeFile bool) error {
+	if writeFile && len(args) == 0 {
+		result, err := c.fet.CompileAll()
+		for _, tpl := range result.Files {
+			fmt.Fprintf(c.stdout, "compiled %s\n", c.fet.ShortTmplPath(tpl))
+		}
+		return err
+	}
+	files, err := c.files(args)
+	if err != nil {
+		return err
+	}
+	failed := false
+	for _, tpl := range files {
+		if _, _, err := c.fet.Compile(tpl, writeFile); err != nil {
+			fmt.Fprintln(c.stderr, err)
+			failed = true
+		} else if writeFile {
+			fmt.Fprintf(c.stdout, "compiled %s\n", c.fet.ShortTmplPath(tpl))
+		} else {
+			fmt.Fprintf(c.stdout, "ok %s\n", c.fet.ShortTmplPath(tpl))
+		}
+	}
+	if failed {
+		return errReported
+	}
+	return nil
+}
+
+// render the template with the json data
+func (c *cli) render(args []string) error {
+	flags := flag.NewFlagSet("render", flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+	dataFile := flags.String("data", "", "the json data file, '-' means read from stdin")
+	if err := flags.Parse(args); err != nil {
+		return errReported
+	}
+	if flags.NArg() != 1 {
+		return errors.New("render need one template file")
+	}
+	var data interface{}
+	if *dataFile != "" {
+		var (
+			content []byte
+			err     error
+		)
+		if *dataFile == "-" {
+			content, err = ioutil.ReadAll(c.stdin)
+		} else {
+			content, err = ioutil.ReadFile(*dataFile)
+		}
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(content, &data); err != nil {
+			return fmt.Errorf("read data file error:%s", err.Error())
+		}
+	}
+	// render the template source rather than the compiled file
+	c.fet.Config.CompileOnline = true
+	return c.fet.Display(flags.Arg(0), data, c.stdout)
+}
+
+// print the dependencies of the templates
+func (c *cli) deps(args []string) error {
+	files, err := c.files(args)
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	failed := false
+	for _, tpl := range files {
+		_, deps, err := c.fet.Compile(tpl, false)
+		if err != nil {
+			fmt.Fprintln(c.stderr, err)
+			failed = true
+			continue
+		}
+		fmt.Fprintf(c.stdout, "%s\n", c.fet.ShortTmplPath(tpl))
+		for _, dep := range deps {
+			fmt.Fprintf(c.stdout, "  %s\n", c.fet.ShortTmplPath(dep))
+		}
+	}
+	if failed {
+		return errReported
+	}
+	return nil
+}
+
+// watch the template directory until interrupted
+func (c *cli) watch() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	err := c.fet.Watch(ctx, func(files []string, err error) {
+		for _, tpl := range files {
+			fmt.Fprintf(c.stdout, "compiled %s\n", c.fet.ShortTmplPath(tpl))
+		}
+		if err != nil {
+			fmt.Fprintln(c.stderr, err)
+		}
+	})
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
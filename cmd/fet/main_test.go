@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fefit/fet"
+	"github.com/fefit/fet/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	tmplDir, compileDir := t.TempDir(), t.TempDir()
+	writeFile := func(name string, content string) string {
+		file := filepath.Join(tmplDir, name)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(file), os.ModePerm))
+		assert.Nil(t, ioutil.WriteFile(file, []byte(content), 0644))
+		return file
+	}
+	writeFile("index.tpl", `{%include "inc/header.tpl"%}{%$ROOT.Name%}`)
+	writeFile("inc/header.tpl", `hello `)
+	conf, _ := json.Marshal(&fet.Config{
+		Mode:        types.Smarty,
+		TemplateDir: tmplDir,
+		CompileDir:  compileDir,
+		Ignores:     []string{"inc"},
+	})
+	confFile := filepath.Join(t.TempDir(), "fet.json")
+	assert.Nil(t, ioutil.WriteFile(confFile, conf, 0644))
+	runCmd := func(stdin string, args ...string) (int, string, string) {
+		// nothing should be printed to the real stdout besides the given writer
+		osStdout := os.Stdout
+		reader, writer, err := os.Pipe()
+		assert.Nil(t, err)
+		os.Stdout = writer
+		printed := make(chan string)
+		go func() {
+			buf, _ := ioutil.ReadAll(reader)
+			printed <- string(buf)
+		}()
+		stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+		code := run(append([]string{"-config", confFile}, args...), strings.NewReader(stdin), stdout, stderr)
+		os.Stdout = osStdout
+		writer.Close()
+		assert.Equal(t, "", <-printed, args)
+		return code, stdout.String(), stderr.String()
+	}
+	// check
+	code, stdout, _ := runCmd("", "check", "index.tpl")
+	assert.Equal(t, exitOk, code)
+	assert.Equal(t, "ok index.tpl\n", stdout)
+	_, err := os.Stat(filepath.Join(compileDir, "index.tpl"))
+	assert.True(t, os.IsNotExist(err))
+	// compile
+	code, stdout, _ = runCmd("", "compile")
+	assert.Equal(t, exitOk, code)
+	assert.Equal(t, "compiled index.tpl\n", stdout)
+	_, err = os.Stat(filepath.Join(compileDir, "index.tpl"))
+	assert.Nil(t, err)
+	// render
+	code, stdout, stderr := runCmd(`{"Name":"fet"}`, "render", "-data", "-", "index.tpl")
+	assert.Equal(t, exitOk, code, stderr)
+	assert.Equal(t, "hello fet", stdout)
+	// deps
+	code, stdout, _ = runCmd("", "deps", "index.tpl")
+	assert.Equal(t, exitOk, code)
+	assert.Equal(t, "index.tpl\n  inc/header.tpl\n", stdout)
+	// errors
+	writeFile("error.tpl", `{%capture %}`)
+	code, _, stderr = runCmd("", "check", "error.tpl")
+	assert.Equal(t, exitFail, code)
+	assert.Contains(t, stderr, "error.tpl")
+	code, _, _ = runCmd("", "unknown")
+	assert.Equal(t, exitUsage, code)
+}
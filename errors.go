@@ -0,0 +1,178 @@
+package fet
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/fefit/fet/lib/expression"
+)
+
+// Error for template compile errors
+type Error struct {
+	// the template file
+	File string
+	// the line and column number, both begin with 1
+	Line   int
+	Column int
+	// the tag name, e.g. 'if', 'include'
+	Tag string
+	// the original error
+	Cause error
+	// the source code of the error line
+	source string
+}
+
+// Error method for Error
+func (e *Error) Error() string {
+	var errmsg string
+	if e.File != "" {
+		errmsg = "[file:'" + e.File + "']"
+	}
+	// the errors when rendering may have no position, e.g. the output exceeds the max bytes
+	if e.Line > 0 {
+		errmsg += "[line:" + indexString(e.Line) + ",col:" + indexString(e.Column) + "]"
+	}
+	errmsg += "[error]" + e.Cause.Error()
+	return errmsg
+}
+
+// Unwrap method for Error
+func (e *Error) Unwrap() error {
+	return e.Cause
+}
+
+// Excerpt returns the source code of the error line, with a caret pointed to the column
+func (e *Error) Excerpt() string {
+	if e.Line <= 0 || e.Column <= 0 {
+		return ""
+	}
+	lineNo := indexString(e.Line)
+	code := Runes(e.source)
+	// keep the tabs, so the caret can be aligned
+	padding := strings.Builder{}
+	for i := 0; i < e.Column-1 && i < len(code); i++ {
+		if code[i] == '\t' {
+			padding.WriteRune('\t')
+		} else {
+			padding.WriteRune(' ')
+		}
+	}
+	return fmt.Sprintf(" %s | %s\n %s | %s^", lineNo, e.source, strings.Repeat(" ", len(lineNo)), padding.String())
+}
+
+// Errors for all the errors collected when the config 'CollectErrors' is true
+type Errors []error
+
+// Error method for Errors
+func (errs Errors) Error() string {
+	errmsgs := make([]string, len(errs))
+	for i, err := range errs {
+		errmsgs[i] = err.Error()
+	}
+	return strings.Join(errmsgs, "\n")
+}
+
+// Unwrap method for Errors
+func (errs Errors) Unwrap() []error {
+	return errs
+}
+
+// Is method for Errors, reports whether any of the errors matches the target,
+// errors.Is doesn't unwrap the multiple errors before go1.20
+func (errs Errors) Is(target error) bool {
+	for _, err := range errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As method for Errors, finds the first error matches the target
+func (errs Errors) As(target interface{}) bool {
+	for _, err := range errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// append the error to errors, the errors will be flatten and the same errors will be ignored
+func appendErrors(errs Errors, err error) Errors {
+	if list, ok := err.(Errors); ok {
+		for _, cur := range list {
+			errs = appendErrors(errs, cur)
+		}
+		return errs
+	}
+	errmsg := err.Error()
+	for _, cur := range errs {
+		if cur.Error() == errmsg {
+			return errs
+		}
+	}
+	return append(errs, err)
+}
+
+// get the line and column of the rune index in the node's context
+func (node *Node) position(index int) (lineNo int, colNo int, source string) {
+	if node.Context == nil {
+		if node.Position != nil {
+			return node.LineNo, node.StartIndex - node.LineIndex + 1, ""
+		}
+		return 0, 0, ""
+	}
+	strs := *node.Context
+	total := len(strs)
+	if index > total {
+		index = total
+	}
+	lineNo = 1
+	lineStart := 0
+	for i := 0; i < index; i++ {
+		if strs[i] == '\n' {
+			lineNo++
+			lineStart = i + 1
+		}
+	}
+	lineEnd := lineStart
+	for lineEnd < total && strs[lineEnd] != '\n' {
+		lineEnd++
+	}
+	source = strings.TrimSuffix(string(strs[lineStart:lineEnd]), "\r")
+	return lineNo, index - lineStart + 1, source
+}
+
+// haltError wrap the error with the node's position,
+// if the error is an expression error of the content begin at 'contentIndex',
+// the position will be the position of the expression error
+func (node *Node) haltError(err error, contentIndex int) *Error {
+	index := node.StartIndex
+	var expErr *expression.Error
+	if contentIndex >= 0 && errors.As(err, &expErr) {
+		index = contentIndex + expErr.Index
+	}
+	lineNo, colNo, source := node.position(index)
+	return &Error{
+		File:   node.Pwd,
+		Line:   lineNo,
+		Column: colNo,
+		Tag:    node.Name,
+		Cause:  err,
+		source: source,
+	}
+}
+
+// get the rune index of the code in the node's context, returns -1 if the code is not found in the content
+func (node *Node) codeIndex(code string) int {
+	if code == "" {
+		return -1
+	}
+	if index := strings.Index(node.Content, code); index >= 0 {
+		return node.ContentIndex + utf8.RuneCountInString(node.Content[:index])
+	}
+	return -1
+}
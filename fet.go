@@ -2,6 +2,7 @@ package fet
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
@@ -9,13 +10,18 @@ import (
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 
 	"github.com/fefit/fet/lib/expression"
@@ -89,6 +95,11 @@ type CompileOptions struct {
 	LocalScopes   *[]string
 	Includes      *[]string
 	IncludeChains *Imports
+	IncludeDepth  int
+	IncludeTags   *[]includeTag
+	Functions     *map[string]bool
+	Defines       *map[string]string
+	LoopMetas     *map[*Node]*loopMeta
 	Extends       *[]string
 	Captures      *map[string]string
 	ParseOptions  *generator.ParseOptions
@@ -97,6 +108,7 @@ type CompileOptions struct {
 // Node struct
 type Node struct {
 	IsClosed     bool
+	Raw          bool
 	ContentIndex int
 	Name         string
 	Content      string
@@ -129,26 +141,42 @@ type NodeList struct {
 
 var (
 	supportTags = map[string]Type{
-		"include": SingleType,
-		"extends": SingleType,
-		"for":     BlockStartType,
-		"foreach": BlockStartType,
-		"if":      BlockStartType,
-		"elseif":  BlockFeatureType,
-		"else":    BlockFeatureType,
-		"block":   BlockStartType,
-		"capture": BlockStartType,
+		"include":     SingleType,
+		"extends":     SingleType,
+		"for":         BlockStartType,
+		"foreach":     BlockStartType,
+		"if":          BlockStartType,
+		"elseif":      BlockFeatureType,
+		"else":        BlockFeatureType,
+		"foreachelse": BlockFeatureType,
+		"forelse":     BlockFeatureType,
+		"block":       BlockStartType,
+		"capture":     BlockStartType,
+		"break":       SingleType,
+		"continue":    SingleType,
+		"function":    BlockStartType,
+		"call":        SingleType,
+		"while":       BlockStartType,
+		"strip":       BlockStartType,
 	}
 	validateFns = map[string]ValidateFn{
-		"if":      validIfTag,
-		"else":    validElseTag,
-		"elseif":  validElseifTag,
-		"for":     validForTag,
-		"foreach": validForTag,
-		"block":   validBlockTag,
-		"include": validIncludeTag,
-		"extends": validExtendsTag,
-		"capture": validCaptureTag,
+		"if":          validIfTag,
+		"else":        validElseTag,
+		"elseif":      validElseifTag,
+		"foreachelse": validLoopElseTag,
+		"forelse":     validLoopElseTag,
+		"for":         validForTag,
+		"foreach":     validForTag,
+		"block":       validBlockTag,
+		"include":     validIncludeTag,
+		"extends":     validExtendsTag,
+		"capture":     validCaptureTag,
+		"break":       validLoopControlTag,
+		"continue":    validLoopControlTag,
+		"function":    validFunctionTag,
+		"call":        validCallTag,
+		"while":       validWhileTag,
+		"strip":       validStripTag,
 	}
 )
 
@@ -233,6 +261,15 @@ func (imports *Imports) Add(cur string, depend string) []string {
 	return curNode.LookupCircle(nextNode, []*ImportNode{})
 }
 
+// the template name of the source code compiled without a name
+const stringTplName = "string"
+
+// the default interval of polling the template directory
+const defWatchInterval = 500 * time.Millisecond
+
+// the default interval that the cached templates check the modify time of their files
+const defCacheCheckInterval = time.Second
+
 // UnknownType need parse
 const (
 	UnknownType Type = iota
@@ -407,7 +444,7 @@ func parseProps(node *Node, defField string) (*Props, error) {
 	if statu == isInValue && value != "" {
 		values = append(values, value)
 	}
-	if !isHasDefault {
+	if !isHasDefault && defField != "" {
 		return nil, fmt.Errorf("doesn't have default property of '%s'", defField)
 	}
 	count := len(props)
@@ -478,26 +515,99 @@ func (node *Node) Compile(options *CompileOptions) (result string, err error) {
 		Exp:  exp,
 	}
 	toError := func(err error) error {
-		return node.halt(err.Error())
+		return node.haltError(err, -1)
+	}
+	// errors of the expression in the content
+	toContentError := func(err error) error {
+		return node.haltError(err, node.ContentIndex)
+	}
+	// errors of the expression 'code' which is a part of the content
+	toCodeError := func(err error, code string) error {
+		return node.haltError(err, node.codeIndex(code))
+	}
+	// compile the last statements of the c-style 'for' loop
+	compileLoops := func(forNode *Node) (string, error) {
+		res := strings.Builder{}
+		loops := (*forNode.Data)["Loops"]
+		for i, total := 0, len(loops); i < total; {
+			ast, expErr := exp.Parse(loops[i])
+			if expErr != nil {
+				return "", forNode.haltError(expErr, forNode.codeIndex(loops[i]))
+			}
+			varName, _, bErr := gen.Build(ast, genOptions, parseOptions)
+			if bErr != nil {
+				return "", forNode.haltError(fmt.Errorf("parse 'for' loop error:%w", bErr), forNode.codeIndex(loops[i]))
+			}
+			ast, expErr = exp.Parse(loops[i+1])
+			if expErr != nil {
+				return "", forNode.haltError(expErr, forNode.codeIndex(loops[i+1]))
+			}
+			code, _, bErr := gen.Build(ast, genOptions, parseOptions)
+			if bErr != nil {
+				return "", forNode.haltError(fmt.Errorf("parse 'for' loops error:%w", bErr), forNode.codeIndex(loops[i+1]))
+			}
+			res.WriteString(delimit(varName + " = " + code))
+			i += 2
+		}
+		return res.String(), nil
+	}
+	// compile the loop chan driven by the condition of the c-style 'for' and 'while' loops
+	compileLoopChan := func(cond string) string {
+		res := strings.Builder{}
+		chanName := getLoopChanName(node, localNS)
+		before, step := fet.compileLoopLimit(node, localNS)
+		res.WriteString(before)
+		res.WriteString(delimit(chanName + " := (INJECT_MAKE_LOOP_CHAN)"))
+		res.WriteString(delimit("range " + chanName + ".Chan"))
+		res.WriteString(delimit("if " + cond))
+		res.WriteString(step)
+		res.WriteString(delimit(chanName + ".Next"))
+		res.WriteString(delimit("else"))
+		res.WriteString(delimit(chanName + ".Close"))
+		res.WriteString(delimit("end"))
+		res.WriteString(delimit("if (gt " + chanName + ".Loop -1)"))
+		return res.String()
 	}
 	switch node.Type {
 	case CommentType:
 		// output nothing
 	case TextType:
-		// replace all html/template left delimiters to pipeline
-		result = content
-		if conf.LeftDelimiter != "{{" {
-			rule := regexp.MustCompile(`(\{{2,})`)
-			result = rule.ReplaceAllString(result, `{{"$1"}}`)
+		if node.isInStrip() {
+			content = stripRule.ReplaceAllString(content, "")
+		}
+		// replace all html/template left delimiters to pipeline,
+		// the raw text of the literal block may contain them even if the left delimiter is "{{"
+		escape := func(text string) string {
+			if conf.LeftDelimiter != "{{" || node.Raw {
+				rule := regexp.MustCompile(`(\{{2,})`)
+				return rule.ReplaceAllString(text, `{{"$1"}}`)
+			}
+			return text
+		}
+		if conf.Minify && !node.Raw {
+			result = fet.outputCondComments(content, escape)
+		} else {
+			result = escape(content)
 		}
 	case AssignType, OutputType:
+		if isBlockParent(node) {
+			// the block has no parent block
+			break
+		}
+		if len(*options.Functions) > 0 && node.toFuncCall(*options.Functions) {
+			// the function is called before defined, or defined in the include files
+			if errmsg := node.Validate(conf); errmsg != "" {
+				return "", node.halt(errmsg)
+			}
+			return node.Compile(options)
+		}
 		isAssign := node.Type == AssignType
 		if isAssign && !utils.IsIdentifier(name, conf.Mode) {
 			return "", node.halt("wrong identifier '%s', please check the parse mode in fet config", name)
 		}
 		ast, expErr := exp.Parse(content)
 		if expErr != nil {
-			return "", toError(expErr)
+			return "", toContentError(expErr)
 		}
 		if isAssign {
 			if _, ok := generator.LiteralSymbols[name]; ok {
@@ -508,12 +618,12 @@ func (node *Node) Compile(options *CompileOptions) (result string, err error) {
 				symbol = " = "
 			}
 			if compiledText, _, err = gen.Build(ast, genOptions, parseOptions); err != nil {
-				return "", node.halt("%s", err.Error())
+				return "", toContentError(err)
 			}
 			result = delimit(addVarPrefix + name + localNS + symbol + compiledText)
 		} else {
 			if compiledText, noDelimit, err = gen.Build(ast, genOptions, parseOptions); err != nil {
-				return "", node.halt("%s", err.Error())
+				return "", toContentError(err)
 			}
 			if noDelimit {
 				result = compiledText
@@ -522,6 +632,9 @@ func (node *Node) Compile(options *CompileOptions) (result string, err error) {
 			}
 		}
 	case SingleType:
+		if tag, exists := fet.tags[name]; exists {
+			return node.compileCustomTag(tag, genOptions, parseOptions, false)
+		}
 		isInclude := name == "include"
 		if isInclude || name == "extends" {
 			defField := "file"
@@ -542,14 +655,25 @@ func (node *Node) Compile(options *CompileOptions) (result string, err error) {
 				Extends:       extends,
 				Includes:      includes,
 				IncludeChains: includeChains,
+				IncludeDepth:  options.IncludeDepth,
+				IncludeTags:   options.IncludeTags,
+				Functions:     options.Functions,
+				Defines:       options.Defines,
 				File:          tpl,
 				Captures:      incCaptures,
 				ParseOptions: &generator.ParseOptions{
 					Conf:     conf,
 					Captures: incCaptures,
+					Loops:    parseOptions.Loops,
 				},
 			}
 			if isInclude {
+				incOptions.IncludeDepth++
+				// keep the first include tag of each depth, the depth is checked when rendering
+				if tags := incOptions.IncludeTags; len(*tags) < incOptions.IncludeDepth {
+					lineNo, colNo, _ := node.position(node.StartIndex)
+					*tags = append(*tags, includeTag{fet.ShortTmplPath(node.Pwd), lineNo, colNo})
+				}
 				// use relative path, to keep the name
 				relaTpl, _ := filepath.Rel(fet.TemplateDir, tpl)
 				ctx := md5.New()
@@ -568,45 +692,110 @@ func (node *Node) Compile(options *CompileOptions) (result string, err error) {
 						value := prop.Raw
 						if ast, expErr := exp.Parse(value); expErr == nil {
 							if compiledText, _, err = gen.Build(ast, genOptions, parseOptions); err != nil {
-								return "", node.halt("%s", err.Error())
+								return "", toCodeError(err, value)
 							}
 							incLocalScopes = append(incLocalScopes, "$"+key)
 							result += "{{ $" + key + incLocalNS + " := " + compiledText + "}}"
 						} else {
-							return "", toError(expErr)
+							return "", toCodeError(expErr, value)
 						}
 					}
 				}
 			}
 			var incResult string
 			if incResult, err = fet.compileFileContent(tpl, incOptions); err != nil {
+				var tplErr *Error
+				if errs, ok := err.(Errors); ok {
+					// the errors collected in the include file
+					return "", errs
+				} else if errors.As(err, &tplErr) {
+					// the error has the position in the include file
+					return "", err
+				}
 				return "", toError(err)
 			}
 			if isInclude {
 				result += incResult
 			}
 			// ignore extends, special parse
+		} else if name == "call" {
+			funcName := getCallFuncName(node)
+			args := getFuncArgNames(node)
+			if funcName == "" {
+				funcName, _ = getStringField(node, "name")
+			} else if _, ok := (*node.Props)["name"]; ok {
+				// the 'name' is an argument when call the function by it's name
+				args = append(args, "name")
+				sort.Strings(args)
+			}
+			data := "$"
+			if parseOptions.IsInCapture || parseOptions.IsInFunction {
+				data = "$.Data"
+			}
+			result = "{{template \"" + getFuncTplName(funcName) + "\" (INJECT_CAPTURE_SCOPE " + data
+			for _, key := range args {
+				value := (*node.Props)[key].Raw
+				ast, expErr := exp.Parse(value)
+				if expErr != nil {
+					return "", toCodeError(expErr, value)
+				}
+				compiledText, _, err = gen.Build(ast, genOptions, parseOptions)
+				if err != nil {
+					return "", toCodeError(fmt.Errorf("parse the argument '%s' error:%w", key, err), value)
+				}
+				result += " \"" + key + "\" " + compiledText
+			}
+			result += ")}}"
+		} else if name == "break" || name == "continue" {
+			loop := getParentLoop(node)
+			if loop.Type == CommentType {
+				// the loop tag is invalid
+				break
+			}
+			if loop.Name == "while" {
+				if name == "break" {
+					result = delimit(getLoopChanName(loop, localNS) + ".Close")
+				}
+			} else if (*loop.Props)["type"].Raw == "for" {
+				// the c-style 'for' is a range of the loop chan
+				if name == "break" {
+					result = delimit(getLoopChanName(loop, localNS) + ".Close")
+				} else if result, err = compileLoops(loop); err != nil {
+					return "", err
+				}
+			}
+			result += delimit(name)
 		}
 	case BlockStartType:
+		if tag, exists := fet.tags[name]; exists {
+			return node.compileCustomTag(tag, genOptions, parseOptions, false)
+		}
 		if name == "for" || name == "foreach" {
 			props := *node.Props
 			if props["type"].Raw == "foreach" {
 				target := props["list"].Raw
 				ast, expErr := exp.Parse(target)
 				if expErr != nil {
-					return "", toError(expErr)
+					return "", toCodeError(expErr, target)
 				}
 				compiledText, _, err = gen.Build(ast, genOptions, parseOptions)
 				if err != nil {
-					return "", node.halt("parse 'foreach' error:%s", err.Error())
+					return "", toCodeError(fmt.Errorf("parse 'foreach' error:%w", err), target)
 				}
 				key := props["key"].Raw
-				result = "range "
+				value := props["value"].Raw
+				before, step := fet.compileLoopLimit(node, localNS)
+				rangeCode := "range "
 				if key != "" {
-					result += addVarPrefix + key + localNS + ", "
+					rangeCode += addVarPrefix + key + localNS + ", "
 				}
-				result += addVarPrefix + props["value"].Raw + localNS + " := " + compiledText
-				result = delimit(result)
+				rangeCode += addVarPrefix + value + localNS + " := "
+				meta := node.addLoopMeta([]string{value}, localNS, options, false)
+				// range the list kept by the loop properties
+				meta.Code = before + delimit(meta.Name+" := (INJECT_LOOP_META "+compiledText+")") +
+					delimit(rangeCode+meta.Name+".List") + step + delimit(meta.Name+".Next")
+				meta.Plain = before + delimit(rangeCode+compiledText) + step
+				result = meta.placeholder()
 			} else {
 				data := *node.Data
 				vars := data["Vars"]
@@ -617,48 +806,74 @@ func (node *Node) Compile(options *CompileOptions) (result string, err error) {
 				for key, name := range vars {
 					ast, expErr := exp.Parse(initial[key])
 					if expErr != nil {
-						return "", toError(expErr)
+						return "", toCodeError(expErr, initial[key])
 					}
 					compiledText, _, err = gen.Build(ast, genOptions, parseOptions)
 					if err != nil {
-						return "", node.halt("parse 'for' error:%s", err.Error())
+						return "", toCodeError(fmt.Errorf("parse 'for' error:%w", err), initial[key])
 					}
 					res.WriteString(delimit(addVarPrefix + name + localNS + ":=" + compiledText))
 				}
-				suffixNS := indexString(node.StartIndex) + "_" + indexString(node.EndIndex) + localNS
-				chanName := "$loop_" + suffixNS
-				res.WriteString(delimit(chanName + " := (INJECT_MAKE_LOOP_CHAN)"))
-				res.WriteString(delimit("range " + chanName + ".Chan"))
 				// Add condition code
 				conds := data["Conds"][0]
 				// add initial declares
 				currentScopes = append(currentScopes, vars...)
 				ast, expErr := exp.Parse(conds)
 				if expErr != nil {
-					return "", toError(expErr)
+					return "", toCodeError(expErr, conds)
 				}
 				compiledText, _, err = gen.Build(ast, genOptions, parseOptions)
 				if err != nil {
-					return "", node.halt("parse 'for' statement error:%s", err.Error())
+					return "", toCodeError(fmt.Errorf("parse 'for' statement error:%w", err), conds)
 				}
-				res.WriteString(delimit("if " + compiledText))
-				res.WriteString(delimit(chanName + ".Next"))
-				res.WriteString(delimit("else"))
-				res.WriteString(delimit(chanName + ".Close"))
-				res.WriteString(delimit("end"))
-				res.WriteString(delimit("if (gt " + chanName + ".Loop -1)"))
+				meta := node.addLoopMeta(vars, localNS, options, true)
+				meta.Code = delimit(meta.Name+" := (INJECT_LOOP_META)") + compileLoopChan(compiledText) + delimit(meta.Name+".Next")
+				meta.Plain = compileLoopChan(compiledText)
+				res.WriteString(meta.placeholder())
 				result = res.String()
 			}
+		} else if name == "while" {
+			ast, expErr := exp.Parse(content)
+			if expErr != nil {
+				return "", toContentError(expErr)
+			}
+			compiledText, _, err = gen.Build(ast, genOptions, parseOptions)
+			if err != nil {
+				return "", toContentError(fmt.Errorf("parse 'while' statement error:%w", err))
+			}
+			// add if block for variable context
+			result = delimit("if true") + compileLoopChan(compiledText)
 		} else if name == "if" {
 			ast, expErr := exp.Parse(content)
 			if expErr != nil {
-				return "", toError(expErr)
+				return "", toContentError(expErr)
 			}
 			compiledText, _, err = gen.Build(ast, genOptions, parseOptions)
 			if err != nil {
-				return "", node.halt("parse 'if' statement error:%s", err.Error())
+				return "", toContentError(fmt.Errorf("parse 'if' statement error:%w", err))
 			}
 			result = delimit("if " + compiledText)
+		} else if name == "function" {
+			parseOptions.IsInFunction = true
+			funcName, _ := getStringField(node, "name")
+			result = "{{define \"" + getFuncTplName(funcName) + "\"}}"
+			props := *node.Props
+			for _, key := range getFuncArgNames(node) {
+				value := props[key].Raw
+				ast, expErr := exp.Parse(value)
+				if expErr != nil {
+					return "", toCodeError(expErr, value)
+				}
+				compiledText, _, err = gen.Build(ast, genOptions, parseOptions)
+				if err != nil {
+					return "", toCodeError(fmt.Errorf("parse the argument '%s' error:%w", key, err), value)
+				}
+				varName := key
+				if isSmartyMode {
+					varName = "$" + key
+				}
+				result += delimit(addVarPrefix + varName + localNS + " := (INJECT_FUNC_ARG $ \"" + key + "\" " + compiledText + ")")
+			}
 		} else if name == "capture" {
 			parseOptions.IsInCapture = true
 			captureName, _ := getStringField(node, "name")
@@ -681,59 +896,89 @@ func (node *Node) Compile(options *CompileOptions) (result string, err error) {
 		if name == "elseif" {
 			ast, expErr := exp.Parse(content)
 			if expErr != nil {
-				return "", toError(expErr)
+				return "", toContentError(expErr)
 			}
 			compiledText, _, err = gen.Build(ast, genOptions, parseOptions)
 			if err != nil {
-				return "", node.halt("parse 'if' statement error:%s", err.Error())
+				return "", toContentError(fmt.Errorf("parse 'if' statement error:%w", err))
 			}
 			result = delimit("else if " + compiledText)
 		} else if name == "else" {
 			result = delimit("else")
+		} else if name == "foreachelse" || name == "forelse" {
+			loop := node.Parent.Features[0]
+			if loop.Type == CommentType {
+				// the loop tag is invalid
+				break
+			}
+			if (*loop.Props)["type"].Raw == "for" {
+				// the c-style 'for' always range the loop chan, close the loop and check if it has run
+				chanName := getLoopChanName(loop, localNS)
+				result = delimit("end")
+				var loops string
+				if loops, err = compileLoops(loop); err != nil {
+					return "", err
+				}
+				result += loops
+				result += delimit("end") + delimit("if (eq "+chanName+".Count 0)")
+			} else {
+				result = delimit("else")
+			}
 		}
 	case BlockEndType:
 		pair := node.Pair
+		if pair.Type == CommentType {
+			// the block start tag is invalid
+			break
+		}
+		if tag, exists := fet.tags[name]; exists {
+			return pair.compileCustomTag(tag, genOptions, parseOptions, true)
+		}
+		if name == "for" || name == "foreach" {
+			// the loop properties can only be used in the loop
+			if meta, ok := (*options.LoopMetas)[pair.Parent.Features[0]]; ok {
+				meta.restore(*parseOptions.Loops)
+			}
+		}
 		if name == "block" {
 			blockScopes := pair.LocalScopes
 			if len(blockScopes) > 0 {
 				*options.LocalScopes = append(*options.LocalScopes, blockScopes...)
 			}
 		} else if name == "for" {
+			if pair.Name == "forelse" {
+				if loop := pair.Parent.Features[0]; loop.Type != CommentType && (*loop.Props)["type"].Raw == "for" {
+					// close the empty condition and the if block
+					result = delimit("end") + delimit("end")
+				} else {
+					result = delimit("end")
+				}
+				break
+			}
 			props := *pair.Props
 			if props["type"].Raw == "for" {
-				data := *pair.Data
 				// close index condition
 				result += delimit("end")
-				loops := data["Loops"]
-				for i, total := 0, len(loops); i < total; {
-					ast, expErr := exp.Parse(loops[i])
-					if expErr != nil {
-						return "", toError(expErr)
-					}
-					compiledText, _, err = gen.Build(ast, genOptions, parseOptions)
-					if err != nil {
-						return "", node.halt("parse 'for' loop error:%s", err.Error())
-					}
-					ast, expErr = exp.Parse(loops[i+1])
-					if expErr != nil {
-						return "", toError(expErr)
-					}
-					var code string
-					if code, _, err = gen.Build(ast, genOptions, parseOptions); err != nil {
-						return "", node.halt("parse 'for' loops error:%s", err.Error())
-					}
-					compiledText += " = " + code
-					result += delimit(compiledText)
-					i += 2
+				var loops string
+				if loops, err = compileLoops(pair); err != nil {
+					return "", err
 				}
+				result += loops
 				//  first: close range; last: close if
 				result += delimit("end") + delimit("end")
 			} else {
 				result = delimit("end")
 			}
+		} else if name == "while" {
+			// close the index condition, the range and the if block
+			result = delimit("end") + delimit("end") + delimit("end")
+		} else if name == "strip" {
+			// the strip block is only used at compile time
 		} else {
 			if name == "capture" {
 				parseOptions.IsInCapture = false
+			} else if name == "function" {
+				parseOptions.IsInFunction = false
 			}
 			result = delimit("end")
 		}
@@ -745,12 +990,112 @@ func (node *Node) Compile(options *CompileOptions) (result string, err error) {
 
 // halt errors
 func (node *Node) halt(format string, args ...interface{}) error {
-	var errmsg string
-	if node.Pwd != "" {
-		errmsg = "[file:'" + node.Pwd + "']"
+	return node.haltError(fmt.Errorf(format, args...), -1)
+}
+
+// the loop chan variable name of the c-style 'for' block
+func getLoopChanName(node *Node, localNS string) string {
+	return "$loop_" + indexString(node.StartIndex) + "_" + indexString(node.EndIndex) + localNS
+}
+
+// the loop properties of the loop variables and the named loop
+type loopMeta struct {
+	generator.LoopVar
+	// the loop code with or without the loop properties
+	Code  string
+	Plain string
+	// the loops replaced by the loop, restore them when the loop is closed
+	prevs map[string]*generator.LoopVar
+}
+
+// the placeholder of the loop code, replaced when the loop properties are known to be used or not
+func (meta *loopMeta) placeholder() string {
+	return "\x00" + meta.Name + "\x00"
+}
+
+// the loop code to replace the placeholder
+func (meta *loopMeta) code() string {
+	if *meta.Used {
+		return meta.Code
+	}
+	return meta.Plain
+}
+
+// restore the loops replaced by the loop
+func (meta *loopMeta) restore(loops map[string]generator.LoopVar) {
+	for key, prev := range meta.prevs {
+		if prev == nil {
+			delete(loops, key)
+		} else {
+			loops[key] = *prev
+		}
+	}
+}
+
+// add the loop properties of the loop variables and the named loop,
+// the generator marks them as used when they are used in the loop
+func (node *Node) addLoopMeta(vars []string, localNS string, options *CompileOptions, noTotal bool) *loopMeta {
+	parseOptions := options.ParseOptions
+	addVarPrefix := "$"
+	if node.Fet.Mode == types.Smarty {
+		addVarPrefix = ""
+	}
+	meta := &loopMeta{
+		LoopVar: generator.LoopVar{
+			Name:    "$meta_" + indexString(node.StartIndex) + "_" + indexString(node.EndIndex) + localNS,
+			NoTotal: noTotal,
+			Used:    new(bool),
+		},
+		prevs: map[string]*generator.LoopVar{},
+	}
+	keys := []string{}
+	for _, name := range vars {
+		keys = append(keys, addVarPrefix+name+localNS)
+	}
+	if prop, ok := (*node.Props)["name"]; ok {
+		keys = append(keys, "$fet.foreach."+prop.Raw)
+	}
+	if parseOptions.Loops == nil {
+		parseOptions.Loops = &map[string]generator.LoopVar{}
+	}
+	loops := *parseOptions.Loops
+	for _, key := range keys {
+		if prev, ok := loops[key]; ok {
+			meta.prevs[key] = &prev
+		} else {
+			meta.prevs[key] = nil
+		}
+		loops[key] = meta.LoopVar
 	}
-	errmsg += "[line:" + indexString(node.LineNo) + ",col:" + indexString(node.StartIndex-node.LineIndex+1) + "][error]" + fmt.Sprintf(format, args...)
-	return errors.New(errmsg)
+	(*options.LoopMetas)[node] = meta
+	return meta
+}
+
+// the spaces with newlines removed in the strip block
+var stripRule = regexp.MustCompile(`[\t ]*[\r\n]+[\t ]*`)
+
+// check if the text node is in a strip block, the raw text of literal block is kept
+func (node *Node) isInStrip() bool {
+	if node.Raw {
+		return false
+	}
+	for parent := node.Parent; parent != nil; parent = parent.Parent {
+		if parent.Type != BlockType && parent.Name == "strip" {
+			return true
+		}
+	}
+	return false
+}
+
+// the closest 'for' or 'foreach' block start node
+func getParentLoop(node *Node) *Node {
+	for parent := node.Parent; parent != nil; parent = parent.Parent {
+		// the invalid loop tag will be a comment
+		if parent.Type != BlockType && (parent.Name == "for" || parent.Name == "foreach" || parent.Name == "while") {
+			return parent
+		}
+	}
+	return nil
 }
 
 func getPrevFeature(node *Node) (feature *Node) {
@@ -817,16 +1162,46 @@ func validElseifTag(node *Node, conf *Config) (errmsg string) {
 	}
 	return errmsg
 }
+func validLoopElseTag(node *Node, conf *Config) (errmsg string) {
+	if node.Content != "" {
+		errmsg = "the \"" + node.Name + "\" tag should not have any properties"
+	} else if getPrevFeature(node.Parent) != nil {
+		errmsg = "the \"" + node.Name + "\" tag can only be used once in a loop block"
+	} else {
+		errmsg = validIfBlockCorrect(node, strings.TrimSuffix(node.Name, "else"))
+	}
+	return errmsg
+}
 func validBlockTag(node *Node, conf *Config) (errmsg string) {
-	block := node.Parent
-	if block != nil && block.Parent != nil {
-		errmsg = "the \"block\" tag should be root tag,can not appears in \"" + block.Parent.Name + "\""
+	// the block can be nested in blocks
+	parent := node.Parent.Parent
+	for parent != nil && parent.Type != BlockType && parent.Name == "block" {
+		parent = parent.Parent.Parent
+	}
+	if parent != nil {
+		errmsg = "the \"block\" tag should be root tag,can not appears in \"" + parent.Name + "\""
 	} else {
+		// the mode of the block, e.g. {%block "name" append%}
+		if fields := strings.Fields(node.Content); len(fields) > 1 {
+			if mode := fields[len(fields)-1]; mode == "append" || mode == "prepend" {
+				node.Content = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(node.Content), mode))
+				node.Data = &map[string][]string{
+					"Mode": {mode},
+				}
+			}
+		}
 		errmsg = validIfHasProps(node, "name", true)
 	}
 	return errmsg
 }
 
+func validStripTag(node *Node, conf *Config) (errmsg string) {
+	if node.Content != "" {
+		errmsg = "the \"strip\" tag should not have any properties"
+	}
+	return errmsg
+}
+
 func validCaptureTag(node *Node, conf *Config) (errmsg string) {
 	capture := node.Parent
 	if capture != nil && capture.Parent != nil {
@@ -837,10 +1212,114 @@ func validCaptureTag(node *Node, conf *Config) (errmsg string) {
 	return errmsg
 }
 
+func validWhileTag(node *Node, conf *Config) (errmsg string) {
+	if node.Content == "" {
+		errmsg = "the \"while\" tag does not have a condition expression"
+	}
+	return errmsg
+}
+
+func validFunctionTag(node *Node, conf *Config) (errmsg string) {
+	function := node.Parent
+	if function != nil && function.Parent != nil {
+		return "the \"function\" tag should be root tag,can not appears in \"" + function.Parent.Name + "\""
+	}
+	if errmsg = validIfHasProps(node, "name", false); errmsg != "" {
+		return errmsg
+	}
+	funcName, err := getStringField(node, "name")
+	if err != nil {
+		return err.Error()
+	}
+	if !utils.IsIdentifier(funcName, types.Gofet) {
+		return fmt.Sprintf("the function name '%s' is not a valid identifier", funcName)
+	}
+	if _, exists := node.Fet.tagType(funcName); exists {
+		return fmt.Sprintf("the function name '%s' is a tag name", funcName)
+	}
+	return errmsg
+}
+
+func validCallTag(node *Node, conf *Config) (errmsg string) {
+	if getCallFuncName(node) != "" {
+		// the function is called by it's name, e.g. {%menu items=$items%}
+		if node.Content == "" {
+			node.Props = &Props{}
+			return errmsg
+		}
+		return validIfHasProps(node, "", false)
+	}
+	return validIfHasProps(node, "name", false)
+}
+
+// the function name of the call tag used the function name as tag name
+func getCallFuncName(node *Node) string {
+	if node.Data != nil {
+		if names := (*node.Data)["Func"]; len(names) > 0 {
+			return names[0]
+		}
+	}
+	return ""
+}
+
+// change the output node to the call tag if it begins with a function name, e.g. {%menu items=$items%},
+// the tag with properties is parsed as an assignment, so get it's code from the context
+func (node *Node) toFuncCall(funcNames map[string]bool) bool {
+	start := node.ContentIndex
+	content := Runes(node.Content)
+	if node.Type == AssignType {
+		name := Runes(strings.TrimSpace(node.Name))
+		end := node.ContentIndex + len(content)
+		for start = node.StartIndex; start+len(name) <= end; start++ {
+			if string((*node.Context)[start:start+len(name)]) == string(name) {
+				break
+			}
+		}
+		content = (*node.Context)[start:end]
+	}
+	total := len(content)
+	index := 0
+	for index < total && !unicode.IsSpace(content[index]) {
+		index++
+	}
+	funcName := string(content[:index])
+	if !funcNames[funcName] {
+		return false
+	}
+	for index < total && unicode.IsSpace(content[index]) {
+		index++
+	}
+	node.Type = SingleType
+	node.Name = "call"
+	node.Data = &map[string][]string{
+		"Func": {funcName},
+	}
+	node.ContentIndex = start + index
+	node.Content = string(content[index:])
+	return true
+}
+
+// the sorted argument names of the function tag or the call tag, exclude the 'name'
+func getFuncArgNames(node *Node) []string {
+	names := []string{}
+	for key := range *node.Props {
+		if key != "name" {
+			names = append(names, key)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// the name of the template defined by the function tag
+func getFuncTplName(funcName string) string {
+	return "$function_" + funcName
+}
+
 func validForTag(node *Node, conf *Config) (errmsg string) {
 	name := node.Name
-	content := node.Content
-	runes := Runes(node.Content)
+	content, loopName := splitLoopName(node.Content)
+	runes := Runes(content)
 	segs := []string{}
 	total := 0
 	maxNum := 2
@@ -1170,6 +1649,30 @@ func validForTag(node *Node, conf *Config) (errmsg string) {
 			Raw: "foreach",
 		}
 	}
+	if loopName != "" && errmsg == "" {
+		(*node.Props)["name"] = &Prop{
+			Raw: loopName,
+		}
+	}
+	return errmsg
+}
+
+// the name of the loop, used for the loop properties '$fet.foreach.name'
+var loopNameRule = regexp.MustCompile(`\s+name\s*=\s*"([A-Za-z_][A-Za-z0-9_]*)"\s*$`)
+
+// split the loop name from the content of the loop tag
+func splitLoopName(content string) (string, string) {
+	if matches := loopNameRule.FindStringSubmatchIndex(content); matches != nil {
+		return content[:matches[0]], content[matches[2]:matches[3]]
+	}
+	return content, ""
+}
+func validLoopControlTag(node *Node, conf *Config) (errmsg string) {
+	if node.Content != "" {
+		errmsg = "the \"" + node.Name + "\" tag should not have any properties"
+	} else if getParentLoop(node) == nil {
+		errmsg = "the \"" + node.Name + "\" tag can only be used in \"for\", \"foreach\" or \"while\" block"
+	}
 	return errmsg
 }
 func validIncludeTag(node *Node, conf *Config) (errmsg string) {
@@ -1194,6 +1697,9 @@ func (node *Node) Validate(conf *Config) (errmsg string) {
 		name := node.Name
 		if fn, exists := validateFns[name]; exists {
 			errmsg = fn(node, conf)
+		} else if tag, exists := node.Fet.tags[name]; exists && node.Type != AssignType {
+			// the assignment of the variable with the same name in Gofet mode isn't a tag
+			errmsg = validCustomTag(node, tag)
 		}
 	}
 	return errmsg
@@ -1209,6 +1715,10 @@ type Fet struct {
 	gen         *generator.Generator
 	cwd         string
 	tmpl        *template.Template
+	funcs       template.FuncMap
+	tags        map[string]*Tag
+	cache       *templateCache
+	loader      Loader
 }
 
 // default config
@@ -1240,6 +1750,9 @@ func mergeConfig(options *Config) *Config {
 	if options.CompileDir != "" {
 		conf.CompileDir = options.CompileDir
 	}
+	if options.Mode != 0 {
+		conf.Mode = options.Mode
+	}
 	// ignores
 	if options.Ignores != nil {
 		conf.Ignores = options.Ignores
@@ -1260,6 +1773,47 @@ func mergeConfig(options *Config) *Config {
 	if options.Debug {
 		conf.Debug = true
 	}
+	if options.CollectErrors {
+		conf.CollectErrors = true
+	}
+	if options.Parallel > 0 {
+		conf.Parallel = options.Parallel
+	}
+	if options.Incremental {
+		conf.Incremental = true
+	}
+	if options.Version != "" {
+		conf.Version = options.Version
+	}
+	if options.TrimBlocks {
+		conf.TrimBlocks = true
+	}
+	if options.Minify {
+		conf.Minify = true
+	}
+	if options.WatchInterval > 0 {
+		conf.WatchInterval = options.WatchInterval
+	}
+	if options.CacheCheckInterval != 0 {
+		conf.CacheCheckInterval = options.CacheCheckInterval
+	}
+	// execution limits
+	if options.MaxLoopIterations > 0 {
+		conf.MaxLoopIterations = options.MaxLoopIterations
+	}
+	if options.MaxTotalIterations > 0 {
+		conf.MaxTotalIterations = options.MaxTotalIterations
+	}
+	if options.MaxOutputBytes > 0 {
+		conf.MaxOutputBytes = options.MaxOutputBytes
+	}
+	if options.MaxIncludeDepth > 0 {
+		conf.MaxIncludeDepth = options.MaxIncludeDepth
+	}
+	// loader
+	if options.Loader != nil {
+		conf.Loader = options.Loader
+	}
 	return &conf
 }
 func buildMatchTagFn(len int, tag *Runes) MatchTagFn {
@@ -1297,20 +1851,32 @@ func New(config *Config) (fet *Fet, err error) {
 	if err != nil {
 		cwd = ""
 	}
+	checkInterval := time.Duration(config.CacheCheckInterval) * time.Millisecond
+	if checkInterval == 0 {
+		checkInterval = defCacheCheckInterval
+	}
 	fet = &Fet{
 		Config: config,
 		Params: params,
 		cwd:    cwd,
 		exp:    exp,
 		gen:    gen,
+		cache:  newTemplateCache(checkInterval),
 	}
 	fet.CompileDir = fet.getLastDir(config.CompileDir)
 	fet.TemplateDir = fet.getLastDir(config.TemplateDir)
+	if config.Loader != nil {
+		fet.loader = config.Loader
+	} else {
+		fet.loader = NewOSLoader(fet.TemplateDir)
+	}
 	if err := fet.CheckConfig(); err != nil {
 		return nil, err
 	}
+	fet.funcs = funcs.All()
+	fet.funcs["INJECT_LOOP_LIMIT"] = fet.newLoopLimit
 	tmpl := template.New("")
-	tmpl = tmpl.Funcs(funcs.All())
+	tmpl = tmpl.Funcs(fet.funcs).Funcs(funcs.WithContext(context.Background(), fet.funcs))
 	fet.tmpl = tmpl
 	return fet, nil
 }
@@ -1381,6 +1947,13 @@ func rtrim(strs *Runes, start int, end int) string {
 	return string((*strs)[start:end])
 }
 
+/**
+ * loop control tags
+ */
+func isLoopControlTag(name string) bool {
+	return name == "break" || name == "continue"
+}
+
 /**
  * close node type
  */
@@ -1394,15 +1967,43 @@ func (fet *Fet) wrapCode(code string) string {
 	return "{{" + code + "}}"
 }
 
+// find the end tag of the literal block begin at the index, returns the start and end index of the end tag
+func (fet *Fet) matchLiteralEnd(strs *Runes, index int, total int) (start int, end int, ok bool) {
+	name := Runes("/literal")
+	for start = index; start < total; start++ {
+		if string((*strs)[start]) != fet.startTagBeginChar {
+			continue
+		}
+		cur, isTagStart := fet.matchStartTag(strs, start, total)
+		if !isTagStart {
+			continue
+		}
+		cur = ltrimIndex(strs, cur+1, total)
+		if cur+len(name) > total || string((*strs)[cur:cur+len(name)]) != string(name) {
+			continue
+		}
+		cur = ltrimIndex(strs, cur+len(name), total)
+		if cur < total && string((*strs)[cur]) == fet.endTagBeginChar {
+			if end, ok = fet.matchEndTag(strs, cur, total); ok {
+				return start, end, true
+			}
+		}
+	}
+	return start, end, false
+}
+
 // parse
 func (fet *Fet) parse(codes string, pwd string) (result *NodeList, err error) {
 	var (
-		isInComment, isTagStart, isInBlockTag, isSubTemplate bool
-		node                                                 *Node
-		quote                                                *Quote
-		markIndex, lineNo, lineIndex, blockStartIndex        int
-		blocks                                               []*Node
-		queues                                               []*Node
+		isInComment, isTagStart, isSubTemplate bool
+		trimSpaces, trimNewline                bool
+		node                                   *Node
+		quote                                  *Quote
+		markIndex, lineNo, lineIndex           int
+		blockStarts                            []int
+		blocks                                 []*Node
+		queues                                 []*Node
+		errs                                   Errors
 	)
 	specials := NodeSets{}
 	globals := []string{}
@@ -1426,11 +2027,25 @@ func (fet *Fet) parse(codes string, pwd string) (result *NodeList, err error) {
 		markIndex = 0
 	}
 	isNeedScope := func() bool {
-		return !isSubTemplate || isInBlockTag
+		return !isSubTemplate || len(blockStarts) > 0
 	}
 	addSpecial := func(name string, node *Node) {
 		specials[name] = append(specials[name], node)
 	}
+	// collect the error, and treat the invalid node as a comment
+	invalidate := func(node *Node, nodeErr error) {
+		errs = appendErrors(errs, nodeErr)
+		err = nil
+		if nodes, ok := specials[node.Name]; ok {
+			for index, special := range nodes {
+				if special == node {
+					specials[node.Name] = append(nodes[:index:index], nodes[index+1:]...)
+					break
+				}
+			}
+		}
+		node.Type = CommentType
+	}
 	popGlobals := func(block *Node) {
 		prevFeature := block.Current
 		locals := prevFeature.LocalScopes
@@ -1440,6 +2055,60 @@ func (fet *Fet) parse(codes string, pwd string) (result *NodeList, err error) {
 	}
 	strs := Runes(codes)
 	total := len(strs)
+	// the functions defined in the template, they can be called as tags
+	funcNames := map[string]bool{}
+	// the variables declared or assigned in the template shadow the custom tags in Gofet mode,
+	// they have no '$' prefix, the index is the end of the name
+	isShadowedTag := func(name string, index int) bool {
+		if fet.Mode != types.Gofet {
+			return false
+		}
+		if _, isCustom := fet.tags[name]; !isCustom {
+			return false
+		}
+		if contains(globals, name) {
+			return true
+		}
+		// e.g. {%asset = 1%}
+		for index < total && unicode.IsSpace(strs[index]) {
+			index++
+		}
+		return index+1 < total && strs[index] == '=' && strs[index+1] != '='
+	}
+	getTagType := func(node *Node, index int) (Type, bool) {
+		if funcNames[node.Name] {
+			node.Data = &map[string][]string{
+				"Func": {node.Name},
+			}
+			node.Name = "call"
+			return SingleType, true
+		}
+		if isShadowedTag(node.Name, index) {
+			return UnknownType, false
+		}
+		return fet.tagType(node.Name)
+	}
+	// link the block start node to a new block
+	openBlock := func(node *Node, position *Position) {
+		block := getLastBlock()
+		pnode := &Node{
+			Indexs: Indexs{
+				StartIndex: node.StartIndex,
+			},
+			Type:     BlockType,
+			Name:     node.Name,
+			Position: position,
+			Context:  &strs,
+			Fet:      fet,
+			Pwd:      pwd,
+		}
+		pnode.AddFeature(node)
+		if block != nil {
+			pnode.Parent = block.Current
+		}
+		blocks = append(blocks, pnode)
+		node.Parent = pnode
+	}
 LOOP:
 	for i := 0; i < total; i++ {
 		rn := strs[i]
@@ -1482,35 +2151,17 @@ LOOP:
 				if node.Type == UnknownType {
 					if code == " " {
 						node.Name = rtrim(&strs, markIndex+1, i)
-						if curType, exists := supportTags[node.Name]; exists {
+						if curType, exists := getTagType(node, i); exists {
 							node.Type = curType
 							markIndex = i
 							block := getLastBlock()
 							name := node.Name
 							switch curType {
 							case BlockStartType:
-								pnode := &Node{
-									Indexs: Indexs{
-										StartIndex: node.StartIndex,
-									},
-									Type:     BlockType,
-									Name:     name,
-									Position: position,
-									Context:  &strs,
-									Fet:      fet,
-									Pwd:      pwd,
-								}
 								if name == "block" {
-									addSpecial(name, node)
-									isInBlockTag = true
-									blockStartIndex = len(queues) - 1
+									blockStarts = append(blockStarts, len(queues)-1)
 								}
-								pnode.AddFeature(node)
-								if block != nil {
-									pnode.Parent = block.Current
-								}
-								blocks = append(blocks, pnode)
-								node.Parent = pnode
+								openBlock(node, position)
 							case BlockFeatureType:
 								if block != nil {
 									popGlobals(block)
@@ -1587,15 +2238,84 @@ LOOP:
 				} else if code == fet.endTagBeginChar {
 					curIndex, isTagEnd := fet.matchEndTag(&strs, i, total)
 					if isTagEnd {
+						// the end of the tag content, exclude the trim marker '-'
+						tagEnd := i
+						if i-2 > markIndex && strs[i-1] == '-' && unicode.IsSpace(strs[i-2]) {
+							tagEnd = i - 1
+							trimSpaces = true
+						}
 						// start
 						node.IsClosed = true
 						node.EndIndex = curIndex + 1
 						isUnknownType := node.Type == UnknownType
+						if isUnknownType && rtrim(&strs, markIndex+1, tagEnd) == "literal" {
+							// the contents of the literal block are output as text
+							start, end, ok := fet.matchLiteralEnd(&strs, curIndex+1, total)
+							if !ok {
+								err = node.halt("unclosed block tag \"literal\"")
+								break
+							}
+							node.Name = "literal"
+							node.Type = CommentType
+							setFeatureChild(node)
+							textIndex := curIndex + 1
+							if fet.TrimBlocks {
+								if textIndex+1 < start && strs[textIndex] == '\r' && strs[textIndex+1] == '\n' {
+									textIndex += 2
+								} else if textIndex < start && strs[textIndex] == '\n' {
+									textIndex++
+								}
+							}
+							if textIndex < start {
+								text := &Node{
+									Type: TextType,
+									Raw:  true,
+									Indexs: Indexs{
+										StartIndex: textIndex,
+										EndIndex:   start,
+									},
+									IsClosed:     true,
+									Content:      string(strs[textIndex:start]),
+									Position:     position,
+									Context:      &strs,
+									Fet:          fet,
+									GlobalScopes: globals,
+									Pwd:          pwd,
+								}
+								setFeatureChild(text)
+								queues = append(queues, text)
+							}
+							// keep the line numbers
+							for index := i + 1; index <= end; index++ {
+								if strs[index] == '\n' {
+									lineNo++
+									lineIndex = index
+								}
+							}
+							trimSpaces = false
+							trimNewline = fet.TrimBlocks
+							i = end
+							initToStart()
+							continue
+						}
+						if isUnknownType {
+							if name := rtrim(&strs, markIndex+1, tagEnd); (fet.isBareTag(name) && !isShadowedTag(name, tagEnd)) || funcNames[name] {
+								// tags without properties, e.g. break, continue
+								node.Name = name
+								node.Type, _ = getTagType(node, tagEnd)
+								if node.Type == BlockStartType {
+									openBlock(node, position)
+								}
+								markIndex = tagEnd - 1
+								isUnknownType = false
+							}
+						}
 						if node.Type == BlockEndType || isUnknownType {
-							name := rtrim(&strs, markIndex+1, i)
+							name := rtrim(&strs, markIndex+1, tagEnd)
 							block := getLastBlock()
 							setOutputType := func() {
 								node.Type = OutputType
+								node.ContentIndex = ltrimIndex(&strs, markIndex+1, tagEnd)
 								node.Content = name
 								setFeatureChild(node)
 								initToStart()
@@ -1619,6 +2339,15 @@ LOOP:
 										node.Type = BlockFeatureType
 										popGlobals(block)
 										block.AddFeature(node)
+										if errmsg := node.Validate(fet.Config); errmsg != "" {
+											if err = node.halt(errmsg); !fet.CollectErrors {
+												break
+											}
+											invalidate(node, err)
+											// remove the invalid feature from the block
+											block.Features = block.Features[:len(block.Features)-1]
+											block.Current = block.Features[len(block.Features)-1]
+										}
 									} else {
 										setOutputType()
 									}
@@ -1631,8 +2360,10 @@ LOOP:
 										closeTag(block, curIndex)
 										current := block.Current
 										if name == "block" {
-											isInBlockTag = false
-											current.Childs = queues[blockStartIndex:]
+											// the nodes of the block, include the nested blocks
+											last := len(blockStarts) - 1
+											current.Childs = queues[blockStarts[last]:]
+											blockStarts = blockStarts[:last]
 										}
 										node.Pair = current
 										popGlobals(block)
@@ -1642,15 +2373,35 @@ LOOP:
 							}
 						} else {
 							// validate tag
-							noSpaceIndex := ltrimIndex(&strs, markIndex+1, i)
+							noSpaceIndex := ltrimIndex(&strs, markIndex+1, tagEnd)
 							node.ContentIndex = noSpaceIndex
-							node.Content = rtrim(&strs, noSpaceIndex, i)
+							node.Content = rtrim(&strs, noSpaceIndex, tagEnd)
+							if node.Type == SingleType {
+								// block tags and features have been linked to their block
+								setFeatureChild(node)
+							}
 							if errmsg := node.Validate(fet.Config); errmsg != "" {
-								err = node.halt(errmsg)
-								break
+								if err = node.halt(errmsg); !fet.CollectErrors {
+									break
+								}
+								invalidate(node, err)
 							}
-							if node.Type == BlockStartType && (node.Name == "for" || node.Name == "foreach") && isNeedScope() {
-								props := *node.Props
+							if node.Type == BlockStartType && node.Name == "function" {
+								funcName, _ := getStringField(node, "name")
+								funcNames[funcName] = true
+								if isNeedScope() {
+									// the arguments are the local variables of the function
+									for _, key := range getFuncArgNames(node) {
+										if fet.Mode == types.Smarty {
+											key = "$" + key
+										}
+										globals = append(globals, key)
+										node.LocalScopes = append(node.LocalScopes, key)
+									}
+								}
+							}
+							if node.Type == BlockStartType && (node.Name == "for" || node.Name == "foreach") && isNeedScope() {
+								props := *node.Props
 								forType := props["type"].Raw
 								if forType == "foreach" {
 									valueProp := props["value"]
@@ -1668,7 +2419,12 @@ LOOP:
 									node.LocalScopes = append(node.LocalScopes, vars...)
 								}
 							}
-							setFeatureChild(node)
+						}
+						if node != nil && fet.TrimBlocks {
+							switch node.Type {
+							case BlockStartType, BlockFeatureType, BlockEndType:
+								trimNewline = true
+							}
 						}
 						i = curIndex
 						// initial status
@@ -1678,23 +2434,45 @@ LOOP:
 			}
 			continue
 		}
+		// skip the spaces after the trim marker '-', or the newline after the block tag
+		if trimSpaces && unicode.IsSpace(rn) {
+			continue
+		}
+		trimSpaces = false
+		if trimNewline {
+			trimNewline = rn == '\r' && i+1 < total && strs[i+1] == '\n'
+			if trimNewline || rn == '\n' {
+				continue
+			}
+		}
 		// match start tag
 		if code == fet.startTagBeginChar {
 			curIndex, startFlag := fet.matchStartTag(&strs, i, total)
 			if startFlag {
 				// set isTagStart true
 				isTagStart = startFlag
-				// if prev node is text node
-				if node != nil && node.Type == TextType {
-					node.IsClosed = true
-					node.EndIndex = i
-					node.Content = string(strs[node.StartIndex:i])
-				}
 				// judge next
 				nextIndex := curIndex + 1
 				if nextIndex == total {
 					break
 				}
+				// the trim marker '-', remove the spaces before the tag
+				isTrimLeft := strs[nextIndex] == '-' && nextIndex+1 < total && unicode.IsSpace(strs[nextIndex+1])
+				if isTrimLeft {
+					curIndex = nextIndex
+					nextIndex++
+				}
+				// if prev node is text node
+				if node != nil && node.Type == TextType {
+					node.IsClosed = true
+					node.EndIndex = i
+					if isTrimLeft {
+						for node.EndIndex > node.StartIndex && unicode.IsSpace(strs[node.EndIndex-1]) {
+							node.EndIndex--
+						}
+					}
+					node.Content = string(strs[node.StartIndex:node.EndIndex])
+				}
 				next := string(strs[nextIndex])
 				node = &Node{
 					Indexs: Indexs{
@@ -1724,7 +2502,7 @@ LOOP:
 					if next == "/" {
 						// end block
 						node.Type = BlockEndType
-						curIndex = nextIndex
+						curIndex = noSpaceIndex
 					} else {
 						// need parse again
 						node.Type = UnknownType
@@ -1756,78 +2534,226 @@ LOOP:
 		}
 	}
 	// judge if has error
+	if err == nil {
+		// judge if block end,last node is closed.
+		if block := getLastBlock(); block != nil {
+			err = block.halt("unclosed block tag\"%s\"", block.Name)
+		} else if node != nil && node.Type != TextType {
+			err = node.halt("unclosed tag\"%s\"", node.Content)
+		}
+	}
 	if err != nil {
+		if len(errs) > 0 {
+			return nil, appendErrors(errs, err)
+		}
 		return nil, err
 	}
-	// judge if block end,last node is closed.
-	if block := getLastBlock(); block != nil {
-		return nil, block.halt("unclosed block tag\"%s\"", block.Name)
-	}
 	if node != nil {
-		if node.Type != TextType {
-			return nil, node.halt("unclosed tag\"%s\"", node.Content)
-		}
 		node.IsClosed = true
 		node.EndIndex = total
 		node.Content = string(strs[node.StartIndex:node.EndIndex])
 	}
-	return &NodeList{
+	if fet.Minify {
+		minifyNodes(queues)
+	}
+	result = &NodeList{
 		Queues:   queues,
 		Specials: specials,
-	}, nil
+	}
+	if len(errs) > 0 {
+		// the recoverable errors when collect errors
+		return result, errs
+	}
+	return result, nil
 }
 
-// Display method
-func (fet *Fet) Display(tpl string, data interface{}, output io.Writer) (err error) {
-	conf := fet.Config
-	if conf.CompileOnline {
-		var result string
-		if result, err = fet.Fetch(tpl, data); err == nil {
-			_, err = os.Stdout.Write([]byte(result))
-		}
+// Display method, execute the template and write the result to the output directly,
+// the compiled file is used unless the config 'CompileOnline' is true.
+func (fet *Fet) Display(tpl string, data interface{}, output io.Writer) error {
+	return fet.DisplayContext(context.Background(), tpl, data, output)
+}
+
+// DisplayContext same as Display, but abort the execution when the ctx is done
+func (fet *Fet) DisplayContext(ctx context.Context, tpl string, data interface{}, output io.Writer) (err error) {
+	var item *cacheItem
+	if fet.Config.CompileOnline {
+		item, err = fet.parseTemplate(tpl)
+	} else {
+		item, err = fet.parseCompiled(tpl)
+	}
+	if err != nil {
 		return err
 	}
+	return fet.execute(ctx, tpl, item, data, output)
+}
+
+// parse the compiled file of the template, use the cache if it's not changed
+func (fet *Fet) parseCompiled(tpl string) (*cacheItem, error) {
 	compileFile := fet.RealCmplPath(tpl)
-	if _, err = os.Stat(compileFile); err != nil {
+	if item, ok := fet.cache.get(compileFile); ok {
+		return item, nil
+	}
+	if _, err := os.Stat(compileFile); err != nil {
 		if os.IsNotExist(err) {
 			err = fmt.Errorf("the compile file '%s' is not exist", compileFile)
 		}
-		return err
+		return nil, err
+	}
+	buf, err := ioutil.ReadFile(compileFile)
+	if err != nil {
+		return nil, err
 	}
 	tmpl, _ := fet.tmpl.Clone()
-	if buf, rErr := ioutil.ReadFile(compileFile); rErr != nil {
-		err = rErr
-	} else {
-		t, pErr := tmpl.Parse(string(buf))
-		if pErr != nil {
-			err = pErr
-		} else {
-			err = t.Execute(output, data)
-		}
+	code := string(buf)
+	t, err := tmpl.Parse(code)
+	if err != nil {
+		return nil, err
 	}
-	return err
+	return fet.cache.set(compileFile, t, parseIncludeTags(code), []string{compileFile}, os.Stat)
 }
 
 // Fetch method
 func (fet *Fet) Fetch(tpl string, data interface{}) (result string, err error) {
-	tmpl, _ := fet.tmpl.Clone()
-	if code, _, cErr := fet.Compile(tpl, false); cErr != nil {
-		err = cErr
-	} else {
-		t, pErr := tmpl.Parse(code)
-		if pErr != nil {
-			err = pErr
-		} else {
-			buf := new(bytes.Buffer)
-			err = t.Execute(buf, data)
-			if err == nil {
-				result = buf.String()
-			}
+	return fet.FetchContext(context.Background(), tpl, data)
+}
+
+// FetchContext same as Fetch, but abort the execution when the ctx is done
+func (fet *Fet) FetchContext(ctx context.Context, tpl string, data interface{}) (result string, err error) {
+	var item *cacheItem
+	if item, err = fet.parseTemplate(tpl); err == nil {
+		buf := new(bytes.Buffer)
+		err = fet.execute(ctx, tpl, item, data, buf)
+		if err == nil {
+			result = buf.String()
 		}
 	}
 	return
 }
 
+// parse the template file, use the cache if it's dependencies are not changed
+func (fet *Fet) parseTemplate(tpl string) (*cacheItem, error) {
+	tplFile := fet.RealTmplPath(tpl)
+	if item, ok := fet.cache.get(tplFile); ok {
+		return item, nil
+	}
+	tmpl, _ := fet.tmpl.Clone()
+	code, deps, err := fet.Compile(tpl, false)
+	if err != nil {
+		return nil, err
+	}
+	t, err := tmpl.Parse(code)
+	if err != nil {
+		return nil, err
+	}
+	return fet.cache.set(tplFile, t, parseIncludeTags(code), append([]string{tplFile}, deps...), fet.statTemplate)
+}
+
+// contextWriter stop writing when the ctx is done or the output exceeds the max bytes
+type contextWriter struct {
+	ctx      context.Context
+	output   io.Writer
+	file     string
+	maxBytes int
+	written  int
+}
+
+func (cw *contextWriter) Write(p []byte) (int, error) {
+	if err := cw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if cw.maxBytes > 0 && cw.written+len(p) > cw.maxBytes {
+		return 0, &Error{
+			File:  cw.file,
+			Cause: fmt.Errorf("%w:%d", ErrMaxOutputBytes, cw.maxBytes),
+		}
+	}
+	n, err := cw.output.Write(p)
+	cw.written += n
+	return n, err
+}
+
+// execute the parsed template, if the ctx can be done or the execution has limits,
+// the funcs which need a context are bound to the ctx on a reused copy of the template.
+func (fet *Fet) execute(ctx context.Context, tpl string, item *cacheItem, data interface{}, output io.Writer) error {
+	if err := fet.checkIncludeDepth(item.includes); err != nil {
+		return err
+	}
+	hasLimits := fet.hasExecLimits()
+	if ctx.Done() == nil && !hasLimits {
+		return item.tmpl.Execute(output, data)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if hasLimits {
+		ctx = context.WithValue(ctx, execStateKey{}, &execState{})
+	}
+	bound, err := item.bind(ctx, fet.funcs)
+	if err != nil {
+		return err
+	}
+	defer item.release(bound)
+	return bound.tmpl.Execute(&contextWriter{
+		ctx:      ctx,
+		output:   output,
+		file:     tpl,
+		maxBytes: fet.Config.MaxOutputBytes,
+	}, data)
+}
+
+// ClearCache remove all the parsed templates in cache
+func (fet *Fet) ClearCache() {
+	fet.cache.clear()
+}
+
+// the type of error
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// check if the func can be registered with the name
+func validFunc(name string, fn interface{}) error {
+	if strings.HasPrefix(name, "INJECT_") {
+		return fmt.Errorf("the func name '%s' is reserved for internal funcs", name)
+	}
+	if _, ok := generator.LiteralSymbols[name]; ok || expression.IsKeywordOperator(name) {
+		return fmt.Errorf("the func name '%s' is a keyword", name)
+	}
+	if !utils.IsIdentifier(name, types.Gofet) {
+		return fmt.Errorf("the func name '%s' is not a valid identifier", name)
+	}
+	fnType := reflect.TypeOf(fn)
+	if fnType == nil || fnType.Kind() != reflect.Func {
+		return fmt.Errorf("the func '%s' is not a function", name)
+	}
+	numOut := fnType.NumOut()
+	if numOut == 0 || numOut > 2 || (numOut == 2 && fnType.Out(1) != errorType) {
+		return fmt.Errorf("the func '%s' should return one value, or a value and an error", name)
+	}
+	return nil
+}
+
+// AddFunc register a func, it can be called in templates as 'name(args)' or used as a modifier 'value|name:args',
+// if the first parameter of the func is a context.Context, it will receive the ctx of FetchContext and DisplayContext.
+// the funcs should be registered before rendering.
+func (fet *Fet) AddFunc(name string, fn interface{}) error {
+	return fet.Funcs(template.FuncMap{name: fn})
+}
+
+// Funcs register the funcs, same as AddFunc
+func (fet *Fet) Funcs(fns template.FuncMap) error {
+	for name, fn := range fns {
+		if err := validFunc(name, fn); err != nil {
+			return err
+		}
+	}
+	for name, fn := range fns {
+		fet.funcs[name] = fn
+	}
+	fet.tmpl = fet.tmpl.Funcs(fns).Funcs(funcs.WithContext(context.Background(), fns))
+	// the cached templates may use the replaced funcs
+	fet.ClearCache()
+	return nil
+}
+
 func contains(arr []string, key string) bool {
 	for _, cur := range arr {
 		if cur == key {
@@ -1878,106 +2804,232 @@ func (fet *Fet) ShortTmplPath(tpl string) string {
 	return tpl
 }
 
-func (fet *Fet) parseFile(tpl string, blocks []*Node, extends *[]string, nested int) (*NodeList, bool, error) {
+func (fet *Fet) parseFile(tpl string, overrides blockOverrides, extends *[]string, nested int) (*NodeList, bool, error) {
 	shortTpl := fet.ShortTmplPath(tpl)
 	if contains(*extends, tpl) {
 		return nil, true, fmt.Errorf("The 'extends' file '%s' cause a circle dependency.", shortTpl)
 	}
 	isSubTemplate := nested > 0
-	for {
-		if _, err := os.Stat(tpl); err == nil {
-			buf, err := ioutil.ReadFile(tpl)
-			if err != nil {
-				return nil, isSubTemplate, fmt.Errorf("Open the file '%s' failure: %s", shortTpl, err.Error())
-			}
-			content := string(buf)
-			nl, err := fet.parse(content, tpl)
-			if err != nil {
-				return nil, isSubTemplate, err
-			}
-			specials := nl.Specials
-			var curBlocks []*Node
-			if bk, ok := specials["block"]; ok {
-				curBlocks = bk
+	if _, err := fet.statTemplate(tpl); err != nil {
+		if os.IsNotExist(err) {
+			return nil, isSubTemplate, fmt.Errorf("The file '%s' is not exists", tpl)
+		}
+		return nil, isSubTemplate, err
+	}
+	buf, err := fet.loader.ReadFile(fet.loaderName(tpl))
+	if err != nil {
+		return nil, isSubTemplate, fmt.Errorf("Open the file '%s' failure: %s", shortTpl, err.Error())
+	}
+	return fet.parseContent(tpl, string(buf), overrides, extends, nested)
+}
+
+func (fet *Fet) parseContent(tpl string, content string, overrides blockOverrides, extends *[]string, nested int) (*NodeList, bool, error) {
+	isSubTemplate := nested > 0
+	// the errors collected with the node list
+	nl, parseErr := fet.parse(content, tpl)
+	if nl == nil {
+		return nil, isSubTemplate, parseErr
+	}
+	specials := nl.Specials
+	if exts, exists := specials["extends"]; exists {
+		// the blocks of the template override the blocks of the parent template
+		defines := blockOverrides{}
+		for name, override := range overrides {
+			defines[name] = override
+		}
+		resolveBlocks(nl.Queues, overrides, defines)
+		if nested == 0 {
+			*extends = append(*extends, tpl)
+		}
+		filename, _ := getStringField(exts[0], "file")
+		tpl = getRealTplPath(filename, path.Join(tpl, ".."), fet.TemplateDir)
+		nl, _, err := fet.parseFile(tpl, defines, extends, nested+1)
+		*extends = append(*extends, tpl)
+		if parseErr != nil {
+			if nl == nil {
+				return nil, true, appendErrors(appendErrors(nil, parseErr), err)
 			}
-			if exts, exists := specials["extends"]; exists {
-				if curBlocks != nil {
-					blocks = append(blocks, curBlocks...)
-				}
-				if nested == 0 {
-					*extends = append(*extends, tpl)
-				}
-				filename, _ := getStringField(exts[0], "file")
-				tpl = getRealTplPath(filename, path.Join(tpl, ".."), fet.TemplateDir)
-				nl, _, err := fet.parseFile(tpl, blocks, extends, nested+1)
-				*extends = append(*extends, tpl)
-				return nl, true, err
-			}
-			if !isSubTemplate {
-				return nl, isSubTemplate, nil
-			}
-			namedBlocks := map[string]*Node{}
-			for _, block := range blocks {
-				name, _ := getStringField(block, "name")
-				if _, exists := namedBlocks[name]; !exists {
-					namedBlocks[name] = block
-				}
+			err = appendErrors(appendErrors(nil, parseErr), err)
+		}
+		return nl, true, err
+	}
+	if !isSubTemplate {
+		return nl, isSubTemplate, parseErr
+	}
+	nl.Queues = resolveBlocks(nl.Queues, overrides, nil)
+	return nl, isSubTemplate, parseErr
+}
+
+// blockOverride for the block defined in the child templates
+type blockOverride struct {
+	// the nodes begin with the block start tag and end with the block end tag
+	nodes []*Node
+	// the mode of the block in the template which defines it, e.g. 'append', 'prepend'
+	mode string
+}
+
+// blockOverrides the overrides of the blocks by names
+type blockOverrides map[string]*blockOverride
+
+// replace the blocks in the nodes with the overrides, include the nested blocks,
+// if 'defines' is not nil, the final content of every block will be set into it.
+func resolveBlocks(nodes []*Node, overrides blockOverrides, defines blockOverrides) []*Node {
+	result := []*Node{}
+	for index, total := 0, len(nodes); index < total; index++ {
+		node := nodes[index]
+		count := len(node.Childs)
+		if node.Type == BlockStartType && node.Name == "block" && count >= 2 && index+count <= total {
+			name, _ := getStringField(node, "name")
+			inner := resolveBlocks(node.Childs[1:count-1], overrides, defines)
+			block := append([]*Node{node}, inner...)
+			block = append(block, node.Childs[count-1])
+			if override, exists := overrides[name]; exists {
+				block = mergeBlock(block, override)
 			}
-			overides := map[string][]*Node{}
-			counts := map[string]int{}
-			for _, block := range curBlocks {
-				name, _ := getStringField(block, "name")
-				if override, exists := namedBlocks[name]; exists {
-					overides[name] = override.Childs
-					counts[name] = len(block.Childs)
+			if defines != nil {
+				defines[name] = &blockOverride{
+					nodes: block,
+					mode:  getBlockMode(node),
 				}
 			}
-			queues := []*Node{}
-			for index, total := 0, len(nl.Queues); index < total; index++ {
-				node := nl.Queues[index]
-				if node.Type == BlockStartType && node.Name == "block" {
-					blockName, _ := getStringField(node, "name")
-					if count, ok := counts[blockName]; ok {
-						index += count - 1
-						replaces := overides[blockName]
-						queues = append(queues, replaces...)
-						continue
-					}
-				}
-				queues = append(queues, node)
-			}
-			nl.Queues = queues
-			return nl, isSubTemplate, nil
-		} else if os.IsNotExist(err) {
-			return nil, isSubTemplate, fmt.Errorf("The file '%s' is not exists", tpl)
+			result = append(result, block...)
+			index += count - 1
+			continue
+		}
+		result = append(result, node)
+	}
+	return result
+}
+
+// the mode of the block, e.g. {%block "name" append%}
+func getBlockMode(node *Node) string {
+	if node.Data != nil {
+		if modes := (*node.Data)["Mode"]; len(modes) > 0 {
+			return modes[0]
+		}
+	}
+	return ""
+}
+
+// the placeholder of the parent block content
+func isBlockParent(node *Node) bool {
+	return node.Type == OutputType && strings.TrimSpace(node.Content) == "$fet.block.parent"
+}
+
+// merge the child block into the parent block, the nodes begin with the block start tag and end with the block end tag.
+// the placeholder '$fet.block.parent' is replaced with the parent block content,
+// and the content is appended or prepended to the parent block content in the 'append' or 'prepend' mode.
+func mergeBlock(parent []*Node, child *blockOverride) []*Node {
+	nodes := child.nodes
+	total := len(nodes)
+	if len(parent) < 2 || total < 2 {
+		return nodes
+	}
+	parentInner := parent[1 : len(parent)-1]
+	inner := []*Node{}
+	for _, node := range nodes[1 : total-1] {
+		if isBlockParent(node) {
+			inner = append(inner, parentInner...)
 		} else {
-			return nil, isSubTemplate, err
+			inner = append(inner, node)
 		}
 	}
+	switch child.mode {
+	case "append":
+		inner = append(append([]*Node{}, parentInner...), inner...)
+	case "prepend":
+		inner = append(inner, parentInner...)
+	}
+	result := []*Node{nodes[0]}
+	result = append(result, inner...)
+	return append(result, nodes[total-1])
 }
 
 // Compile for string
 func (fet *Fet) compileFileContent(tpl string, options *CompileOptions) (string, error) {
-	blocks := []*Node{}
 	extends := options.Extends
-	nl, _, err := fet.parseFile(tpl, blocks, extends, 0)
-	if err != nil {
+	nl, _, err := fet.parseFile(tpl, blockOverrides{}, extends, 0)
+	if nl == nil {
 		return "", err
 	}
+	return fet.compileNodes(tpl, nl, options, err)
+}
+
+// Compile the source code as the content of template file 'tpl'
+func (fet *Fet) compileStringContent(tpl string, source string, options *CompileOptions) (string, error) {
+	extends := options.Extends
+	nl, _, err := fet.parseContent(tpl, source, blockOverrides{}, extends, 0)
+	if nl == nil {
+		return "", err
+	}
+	return fet.compileNodes(tpl, nl, options, err)
+}
+
+// Compile the parsed nodes
+// the 'parseErr' is the errors collected when parsing
+func (fet *Fet) compileNodes(tpl string, nl *NodeList, options *CompileOptions, parseErr error) (string, error) {
 	result := strings.Builder{}
 	var (
 		code string
-		errs error
+		err  error
+		errs Errors
 	)
+	if parseErr != nil {
+		errs = appendErrors(errs, parseErr)
+	}
 	options.File = tpl
+	options.LoopMetas = &map[*Node]*loopMeta{}
+	// collect the function names first, the functions can be called before defined
 	for _, node := range nl.Queues {
-		if code, errs = node.Compile(options); errs != nil {
-			return "", errs
+		if node.Type == BlockStartType && node.Name == "function" && node.Props != nil {
+			if funcName, _ := getStringField(node, "name"); funcName != "" {
+				(*options.Functions)[funcName] = true
+			}
+		}
+	}
+	// the code of the function tags, they are moved out to the top level of the compiled template
+	defines := map[string]*strings.Builder{}
+	var define *strings.Builder
+	for _, node := range nl.Queues {
+		if code, err = node.Compile(options); err != nil {
+			if !fet.CollectErrors {
+				return "", err
+			}
+			errs = appendErrors(errs, err)
+			continue
+		}
+		isFunction := node.Name == "function"
+		if isFunction && node.Type == BlockStartType {
+			funcName, _ := getStringField(node, "name")
+			define = &strings.Builder{}
+			defines[funcName] = define
+		}
+		if define != nil {
+			define.WriteString(code)
+		} else {
+			result.WriteString(code)
+		}
+		if isFunction && node.Type == BlockEndType {
+			define = nil
+		}
+	}
+	if len(errs) > 0 {
+		return "", errs
+	}
+	// the loop properties are kept only if they are used
+	useLoopMetas := func(code string) string {
+		for _, meta := range *options.LoopMetas {
+			code = strings.Replace(code, meta.placeholder(), meta.code(), 1)
 		}
-		result.WriteString(code)
+		return code
 	}
-	lastCode := result.String()
-	return lastCode, nil
+	// the same function is defined once even if the file is included more than once
+	for funcName, define := range defines {
+		if _, exists := (*options.Defines)[funcName]; !exists {
+			(*options.Defines)[funcName] = useLoopMetas(define.String())
+		}
+	}
+	return useLoopMetas(result.String()), nil
 }
 
 /**
@@ -2046,8 +3098,8 @@ func isDelimiterOk(left string, right string) (bool, error) {
  * ---------------------------
  */
 func (fet *Fet) CheckConfig() error {
-	if notexist, err := isDorfExists(fet.TemplateDir); err != nil {
-		if notexist {
+	if _, err := fet.loader.Stat("."); err != nil {
+		if os.IsNotExist(err) {
 			return fmt.Errorf("the fet template directory '%s' doesn't exist", fet.TemplateDir)
 		}
 		return err
@@ -2084,38 +3136,16 @@ func (fet *Fet) Compile(tpl string, writeFile bool) (string, []string, error) {
 		result string
 		err    error
 	)
-	parentScopes := []string{}
-	localScopes := []string{}
-	includes := []string{}
-	includeChains := Imports{
-		Nodes: map[string]*ImportNode{},
-	}
-	extends := []string{}
-	captures := map[string]string{}
-	deps := []string{}
 	tplFile := fet.RealTmplPath(tpl)
 	compileFile := fet.RealCmplPath(tplFile)
-	conf := fet.Config
-	parseOptions := &generator.ParseOptions{
-		Conf:     conf,
-		Captures: &captures,
-	}
-	options := &CompileOptions{
-		ParentScopes:  parentScopes,
-		LocalScopes:   &localScopes,
-		Includes:      &includes,
-		IncludeChains: &includeChains,
-		Extends:       &extends,
-		Captures:      &captures,
-		ParseOptions:  parseOptions,
-	}
+	options := fet.newCompileOptions()
 	if writeFile {
 		relaTpl, _ := filepath.Rel(fet.TemplateDir, tplFile)
 		defer func() {
 			if err != nil {
 				fet.debug("compile %s fail:%s", relaTpl, err.Error())
 			} else {
-				fmt.Println("compile success:", relaTpl)
+				fet.debug("compile %s success", relaTpl)
 			}
 		}()
 		fet.debug("compile file:%s", relaTpl)
@@ -2123,12 +3153,7 @@ func (fet *Fet) Compile(tpl string, writeFile bool) (string, []string, error) {
 	if result, err = fet.compileFileContent(tplFile, options); err != nil {
 		return "", nil, err
 	}
-	if conf.Glob {
-		basename, _ := filepath.Rel(fet.TemplateDir, tplFile)
-		ext := path.Ext(tplFile)
-		filename := strings.TrimSuffix(basename, ext)
-		result = "{{define \"" + filename + "\"}}" + result + "{{end}}"
-	}
+	result = wrapIncludeTags(*options.IncludeTags, wrapDefines(*options.Defines, fet.wrapGlob(tplFile, result)))
 	if writeFile {
 		dir := path.Dir(compileFile)
 		if notexist, err := isDorfExists(dir); err != nil {
@@ -2144,9 +3169,110 @@ func (fet *Fet) Compile(tpl string, writeFile bool) (string, []string, error) {
 			return "", nil, fmt.Errorf("compile file '%s' failure:%s", compileFile, err.Error())
 		}
 	}
-	deps = append(deps, extends...)
-	deps = append(deps, includes...)
-	return result, deps, nil
+	return result, options.depends(), nil
+}
+
+/**
+ * fet.CompileString
+ * ---------------------------
+ * compile the template source code,
+ * the 'include' and 'extends' files are resolved as the source is the template file 'name'
+ * ---------------------------
+ */
+func (fet *Fet) CompileString(name string, source string) (string, []string, error) {
+	if name == "" {
+		name = stringTplName
+	}
+	tplFile := fet.RealTmplPath(name)
+	options := fet.newCompileOptions()
+	result, err := fet.compileStringContent(tplFile, source, options)
+	if err != nil {
+		return "", nil, err
+	}
+	return wrapIncludeTags(*options.IncludeTags, wrapDefines(*options.Defines, fet.wrapGlob(tplFile, result))), options.depends(), nil
+}
+
+// FetchString get the rendered result of the template source code, the limits are checked as Fetch
+func (fet *Fet) FetchString(source string, data interface{}) (string, error) {
+	tmpl, _ := fet.tmpl.Clone()
+	code, _, err := fet.CompileString("", source)
+	if err != nil {
+		return "", err
+	}
+	t, err := tmpl.Parse(code)
+	if err != nil {
+		return "", err
+	}
+	// the template is executed once, so it's not cached and not cloned
+	item := &cacheItem{
+		tmpl:     t,
+		master:   t,
+		includes: parseIncludeTags(code),
+	}
+	buf := new(bytes.Buffer)
+	if err = fet.execute(context.Background(), stringTplName, item, data, buf); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// the compile options for root template
+func (fet *Fet) newCompileOptions() *CompileOptions {
+	captures := map[string]string{}
+	loops := map[string]generator.LoopVar{}
+	return &CompileOptions{
+		ParentScopes: []string{},
+		LocalScopes:  &[]string{},
+		Includes:     &[]string{},
+		IncludeTags:  &[]includeTag{},
+		Functions:    &map[string]bool{},
+		Defines:      &map[string]string{},
+		IncludeChains: &Imports{
+			Nodes: map[string]*ImportNode{},
+		},
+		Extends:  &[]string{},
+		Captures: &captures,
+		ParseOptions: &generator.ParseOptions{
+			Conf:     fet.Config,
+			Captures: &captures,
+			Loops:    &loops,
+		},
+	}
+}
+
+// wrap the compiled code with define when the 'Glob' config is true
+func (fet *Fet) wrapGlob(tplFile string, result string) string {
+	if fet.Config.Glob {
+		basename, _ := filepath.Rel(fet.TemplateDir, tplFile)
+		ext := path.Ext(tplFile)
+		filename := strings.TrimSuffix(basename, ext)
+		result = "{{define \"" + filename + "\"}}" + result + "{{end}}"
+	}
+	return result
+}
+
+// append the defines of the function tags to the compiled code, the nested defines are not allowed,
+// so they are output at the top level, e.g. out of the 'Glob' define and the 'if' blocks of the include files
+func wrapDefines(defines map[string]string, code string) string {
+	funcNames := make([]string, 0, len(defines))
+	for funcName := range defines {
+		funcNames = append(funcNames, funcName)
+	}
+	sort.Strings(funcNames)
+	result := strings.Builder{}
+	result.WriteString(code)
+	for _, funcName := range funcNames {
+		result.WriteString(defines[funcName])
+	}
+	return result.String()
+}
+
+// the depends of the compiled template, extends and includes
+func (options *CompileOptions) depends() []string {
+	deps := []string{}
+	deps = append(deps, *options.Extends...)
+	deps = append(deps, *options.Includes...)
+	return deps
 }
 
 // NeedIgnore check the file or directory should be ignored.
@@ -2170,16 +3296,20 @@ func (fet *Fet) NeedIgnore(dorf string) bool {
 // get the directory's sub files should compile
 func (fet *Fet) dirCompiledFiles(dir string) ([]string, error) {
 	fileList := []string{}
-	err := filepath.Walk(dir, func(pwd string, info os.FileInfo, err error) error {
+	err := fet.loader.WalkDir(fet.loaderName(dir), func(name string, d fs.DirEntry, err error) error {
+		pwd := path.Join(fet.TemplateDir, name)
 		tpl, _ := filepath.Rel(dir, pwd)
 		if err != nil {
 			fet.debug("read compile file failure:%v", err)
 			return nil
 		}
 		if fet.NeedIgnore(tpl) {
-			return filepath.SkipDir
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
 		}
-		if !info.IsDir() {
+		if !d.IsDir() {
 			fileList = append(fileList, pwd)
 		}
 		return nil
@@ -2192,11 +3322,11 @@ func (fet *Fet) dirCompiledFiles(dir string) ([]string, error) {
 
 // GetCompileFiles get need compiled files
 func (fet *Fet) GetCompileFiles(dorf string) ([]string, error) {
-	var fileInfo os.FileInfo
+	var fileInfo fs.FileInfo
 	var err error
 	fileList := []string{}
 	dorf = fet.getLastDir(dorf)
-	if fileInfo, err = os.Stat(dorf); err != nil {
+	if fileInfo, err = fet.statTemplate(dorf); err != nil {
 		return nil, err
 	}
 	if fileInfo.IsDir() {
@@ -2209,56 +3339,137 @@ func (fet *Fet) GetCompileFiles(dorf string) ([]string, error) {
 	return fileList, nil
 }
 
+// CompileResult for CompileAll
+type CompileResult struct {
+	// the compiled template files, sorted by the file path
+	Files []string
+	// the unchanged template files which are not compiled in incremental mode, sorted by the file path
+	Skipped []string
+	// the dependencies of the compiled template files, include the extends and include files
+	Deps map[string][]string
+}
+
 /**
  * fet.CompileAll
  * ---------------------------
  * compile all the files
  * ---------------------------
  */
-func (fet *Fet) CompileAll() (*sync.Map, error) {
-	var (
-		relations sync.Map
-		deps      []string
-	)
+func (fet *Fet) CompileAll() (*CompileResult, error) {
+	return fet.CompileAllContext(context.Background())
+}
+
+/**
+ * fet.CompileAllContext
+ * ---------------------------
+ * compile all the files concurrently,
+ * the number of goroutines is limited by config 'Parallel',
+ * stop compiling the rest files when the ctx is done.
+ * ---------------------------
+ */
+func (fet *Fet) CompileAllContext(ctx context.Context) (*CompileResult, error) {
+	result := &CompileResult{
+		Files:   []string{},
+		Skipped: []string{},
+		Deps:    map[string][]string{},
+	}
 	// list all the files need compile
 	files, err := fet.dirCompiledFiles(fet.TemplateDir)
 	if err != nil {
-		return &relations, fmt.Errorf("Fail to open the template directory: %s", err.Error())
+		return result, fmt.Errorf("Fail to open the template directory: %s", err.Error())
 	}
 	// if no files need compile
-	total := len(files)
-	if total == 0 {
-		return &relations, nil
+	if len(files) == 0 {
+		return result, nil
+	}
+	sort.Strings(files)
+	// only compile the changed files in incremental mode
+	var manifest *compileManifest
+	if fet.Config.Incremental {
+		manifest = fet.loadManifest()
+		changes := []string{}
+		for _, tpl := range files {
+			if deps, ok := fet.isUpToDate(manifest, tpl); ok {
+				result.Skipped = append(result.Skipped, tpl)
+				result.Deps[tpl] = deps
+			} else {
+				changes = append(changes, tpl)
+			}
+		}
+		files = changes
 	}
-	// if only one file
-	if total == 1 {
-		_, deps, err = fet.Compile(files[0], true)
-		if err == nil {
-			relations.Store(files[0], deps)
+	compiled, deps, errs := fet.compileFiles(ctx, files)
+	var compileErrs Errors
+	for index, tpl := range files {
+		if errs[index] != nil {
+			compileErrs = appendErrors(compileErrs, errs[index])
+		} else if compiled[index] {
+			result.Files = append(result.Files, tpl)
+			result.Deps[tpl] = deps[index]
 		}
-		return &relations, err
+	}
+	if manifest != nil {
+		if err := fet.saveManifest(manifest, result); err != nil {
+			compileErrs = appendErrors(compileErrs, err)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+	if len(compileErrs) > 0 {
+		return result, compileErrs
+	}
+	return result, nil
+}
+
+// compile the files concurrently, the results are in the same order of the files
+func (fet *Fet) compileFiles(ctx context.Context, files []string) (compiled []bool, deps [][]string, errs []error) {
+	total := len(files)
+	compiled = make([]bool, total)
+	deps = make([][]string, total)
+	errs = make([]error, total)
+	parallel := fet.Config.Parallel
+	if parallel <= 0 {
+		parallel = runtime.NumCPU()
+	}
+	if parallel > total {
+		parallel = total
 	}
 	var (
 		wg   sync.WaitGroup
-		errs []string
+		jobs = make(chan int)
 	)
-	// compile the files concurrently
-	wg.Add(total)
-	for _, tpl := range files {
-		go func(tpl string, fet *Fet) {
-			curFet, _ := New(fet.Config)
-			_, deps, err := curFet.Compile(tpl, true)
-			if err != nil {
-				errs = append(errs, err.Error())
-			} else {
-				relations.Store(tpl, deps)
+	// every worker has it's own parser
+	wg.Add(parallel)
+	for i := 0; i < parallel; i++ {
+		go func(curFet *Fet) {
+			defer wg.Done()
+			for index := range jobs {
+				_, deps[index], errs[index] = curFet.Compile(files[index], true)
+				compiled[index] = errs[index] == nil
 			}
-			wg.Done()
-		}(tpl, fet)
+		}(fet.fork())
 	}
-	wg.Wait()
-	if errs != nil {
-		return &relations, fmt.Errorf("Compile error:%s", strings.Join(errs, "\n"))
+LOOP:
+	for index := range files {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			break LOOP
+		case jobs <- index:
+		}
 	}
-	return &relations, nil
+	close(jobs)
+	wg.Wait()
+	return
+}
+
+// fork a fet instance with it's own parser, so it can compile concurrently
+func (fet *Fet) fork() *Fet {
+	curFet := *fet
+	curFet.exp = expression.New()
+	curFet.gen = generator.New(fet.gen.Conf)
+	return &curFet
 }
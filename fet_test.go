@@ -1,9 +1,24 @@
 package fet
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
+	"time"
 
+	"github.com/fefit/fet/lib/expression"
 	"github.com/fefit/fet/types"
 	"github.com/stretchr/testify/assert"
 )
@@ -41,6 +56,19 @@ func TestCompile(t *testing.T) {
 		assertOutputToBe(t, "for.tpl", map[string][]string{
 			"Result": helloFetChars,
 		}, helloFet)
+		// break, continue
+		assertOutputToBe(t, "break.tpl", map[string][]string{
+			"Result": helloFetChars,
+		}, "hello")
+		assertOutputToBe(t, "continue.tpl", map[string][]string{
+			"Result": helloFetChars,
+		}, "hellofet!")
+		assertOutputToBe(t, "for_break.tpl", map[string][]string{
+			"Result": helloFetChars,
+		}, "hello")
+		assertOutputToBe(t, "for_continue.tpl", map[string][]string{
+			"Result": helloFetChars,
+		}, "hellofet!")
 		assertOutputToBe(t, "slice.tpl", map[string][]string{
 			"Result": helloFetChars,
 		}, "hello")
@@ -117,3 +145,953 @@ func TestImportsDepends(t *testing.T) {
 	assert.True(t, len(imports.Add("C", "D")) > 0)
 
 }
+
+// testFet is the fet whose templates are written into a temporary template directory
+type testFet struct {
+	*Fet
+	t *testing.T
+}
+
+// newTestFet create a fet in smarty mode with temporary directories, and write the templates
+func newTestFet(t *testing.T, conf *Config, tpls map[string]string) *testFet {
+	if conf == nil {
+		conf = &Config{}
+	}
+	if conf.Mode == 0 {
+		conf.Mode = types.Smarty
+	}
+	if conf.TemplateDir == "" {
+		conf.TemplateDir = t.TempDir()
+	}
+	if conf.CompileDir == "" {
+		conf.CompileDir = t.TempDir()
+	}
+	fet, err := New(conf)
+	assert.Nil(t, err)
+	tf := &testFet{Fet: fet, t: t}
+	for name, content := range tpls {
+		tf.writeTpl(name, content)
+	}
+	return tf
+}
+
+// writeTpl write the template into the template directory, the sub directories are created
+func (tf *testFet) writeTpl(name string, content string) {
+	file := filepath.Join(tf.TemplateDir, name)
+	assert.Nil(tf.t, os.MkdirAll(filepath.Dir(file), os.ModePerm))
+	assert.Nil(tf.t, ioutil.WriteFile(file, []byte(content), 0644))
+}
+
+// touchTpl change the modify time of the template
+func (tf *testFet) touchTpl(name string, modTime time.Time) {
+	assert.Nil(tf.t, os.Chtimes(filepath.Join(tf.TemplateDir, name), modTime, modTime))
+}
+
+// assertOutputToBe assert the output of the template
+func (tf *testFet) assertOutputToBe(tpl string, data interface{}, output string) {
+	result, err := tf.Fetch(tpl, data)
+	assert.Nil(tf.t, err, tpl)
+	assert.Equal(tf.t, output, result, tpl)
+}
+
+func TestCache(t *testing.T) {
+	fet := newTestFet(t, nil, map[string]string{
+		"index.tpl":  `{%include "header.tpl"%}:index`,
+		"header.tpl": `header`,
+	})
+	modTime := time.Now().Add(-time.Hour)
+	fet.touchTpl("index.tpl", modTime)
+	fet.touchTpl("header.tpl", modTime)
+	fet.assertOutputToBe("index.tpl", nil, "header:index")
+	// the cached template
+	cached, ok := fet.cache.get(fet.RealTmplPath("index.tpl"))
+	assert.True(t, ok)
+	tmpl, err := fet.parseTemplate("index.tpl")
+	assert.Nil(t, err)
+	assert.True(t, cached == tmpl)
+	// change the include file, the files are not checked in the default interval
+	fet.writeTpl("header.tpl", `new header`)
+	fet.touchTpl("header.tpl", modTime.Add(time.Minute))
+	fet.assertOutputToBe("index.tpl", nil, "header:index")
+	// checked after the interval
+	atomic.StoreInt64(&cached.checked, time.Now().Add(-defCacheCheckInterval).UnixNano())
+	fet.assertOutputToBe("index.tpl", nil, "new header:index")
+	// clear cache
+	fet.ClearCache()
+	_, ok = fet.cache.get(fet.RealTmplPath("index.tpl"))
+	assert.False(t, ok)
+	// don't check the modify time of the files
+	fet = newTestFet(t, &Config{
+		TemplateDir:        fet.TemplateDir,
+		CacheCheckInterval: -1,
+	}, nil)
+	fet.assertOutputToBe("index.tpl", nil, "new header:index")
+	fet.writeTpl("header.tpl", `header`)
+	fet.touchTpl("header.tpl", modTime.Add(2*time.Minute))
+	fet.assertOutputToBe("index.tpl", nil, "new header:index")
+	fet.ClearCache()
+	fet.assertOutputToBe("index.tpl", nil, "header:index")
+}
+
+func TestDisplay(t *testing.T) {
+	tmplDir := t.TempDir()
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(tmplDir, "index.tpl"), []byte(`hello {%$ROOT.Name%}`), 0644))
+	conf := &Config{
+		Mode:        types.Smarty,
+		TemplateDir: tmplDir,
+		CompileDir:  t.TempDir(),
+	}
+	data := map[string]string{"Name": "fet"}
+	// the compiled file
+	fet, _ := New(conf)
+	buf := new(bytes.Buffer)
+	assert.NotNil(t, fet.Display("index.tpl", data, buf))
+	_, _, err := fet.Compile("index.tpl", true)
+	assert.Nil(t, err)
+	assert.Nil(t, fet.Display("index.tpl", data, buf))
+	assert.Equal(t, "hello fet", buf.String())
+	// compile online
+	conf.CompileOnline = true
+	fet, _ = New(conf)
+	buf.Reset()
+	assert.Nil(t, fet.Display("index.tpl", data, buf))
+	assert.Equal(t, "hello fet", buf.String())
+}
+
+func TestFetchContext(t *testing.T) {
+	fet := newTestFet(t, nil, map[string]string{
+		"index.tpl":   `{%foreach $ROOT as $item%}{%$item%}{%/foreach%}`,
+		"endless.tpl": `{%for $i = 0; $i >= 0; $i++%}{%/for%}`,
+		"silent.tpl":  `{%foreach $ROOT as $a%}{%foreach $ROOT as $b%}{%foreach $ROOT as $c%}{%/foreach%}{%/foreach%}{%/foreach%}`,
+	})
+	data := []int{1, 2, 3}
+	result, err := fet.FetchContext(context.Background(), "index.tpl", data)
+	assert.Nil(t, err)
+	assert.Equal(t, "123", result)
+	// canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = fet.FetchContext(ctx, "index.tpl", data)
+	assert.True(t, errors.Is(err, context.Canceled))
+	// the endless loop is stopped
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = fet.FetchContext(ctx, "endless.tpl", nil)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	// the loops output nothing are also stopped
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = fet.FetchContext(ctx, "silent.tpl", make([]int, 1000))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	// the cached template is still usable
+	fet.assertOutputToBe("index.tpl", data, "123")
+	// the reused copies of the template get the ctx of their own execution
+	type ctxKey struct{}
+	assert.Nil(t, fet.AddFunc("ctxValue", func(ctx context.Context) string {
+		value, _ := ctx.Value(ctxKey{}).(string)
+		return value
+	}))
+	fet.writeTpl("value.tpl", `{%ctxValue()%}`)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(value string) {
+			defer wg.Done()
+			ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, value))
+			defer cancel()
+			result, err := fet.FetchContext(ctx, "value.tpl", nil)
+			assert.Nil(t, err)
+			assert.Equal(t, value, result)
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+}
+
+func TestFSLoader(t *testing.T) {
+	fsys := fstest.MapFS{
+		"index.tpl":      {Data: []byte(`{%extends "inc/base.tpl"%}{%block "content"%}{%include "inc/header.tpl"%}{%/block%}`)},
+		"inc/base.tpl":   {Data: []byte(`<{%block "content"%}{%/block%}>`)},
+		"inc/header.tpl": {Data: []byte(`header`)},
+	}
+	fet, err := New(&Config{
+		Mode:        types.Smarty,
+		TemplateDir: "embed_templates",
+		Ignores:     []string{"inc"},
+		Loader:      NewFSLoader(fsys),
+	})
+	assert.Nil(t, err)
+	result, err := fet.Fetch("index.tpl", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "<header>", result)
+	files, err := fet.GetCompileFiles(fet.TemplateDir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{fet.RealTmplPath("index.tpl")}, files)
+	// not exist file
+	_, err = fet.Fetch("notexist.tpl", nil)
+	assert.NotNil(t, err)
+}
+
+func TestCompileString(t *testing.T) {
+	fet, _ := New(&Config{
+		Mode:        types.Smarty,
+		TemplateDir: "tests/smarty/templates",
+		UcaseField:  true,
+		AutoRoot:    true,
+	})
+	result, err := fet.FetchString(`{%$hello = "hello"%}{%$hello%} {%$name%}!`, map[string]string{
+		"Name": "fet",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "hello fet!", result)
+	// include and extends
+	result, err = fet.FetchString(`{%include "inc/header.tpl" header="hello"%}`, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "header:hello", result)
+	result, err = fet.FetchString(`{%extends "inc/base.tpl"%}{%block "content"%}(string){%/block%}`, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "(header)\n(string)\n(footer)", result)
+	// relative to the name
+	code, deps, err := fet.CompileString("inc/string.tpl", `{%include "./header.tpl"%}`)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{fet.RealTmplPath("inc/header.tpl")}, deps)
+	assert.True(t, strings.HasPrefix(code, "header:"))
+	// syntax error
+	_, err = fet.FetchString(`{%if $a%}`, nil)
+	assert.NotNil(t, err)
+}
+
+func TestConfigMode(t *testing.T) {
+	// the default mode is Smarty
+	def, err := New(&Config{TemplateDir: t.TempDir(), CompileDir: t.TempDir()})
+	assert.Nil(t, err)
+	assert.Equal(t, types.Smarty, def.Mode)
+	// the mode option is kept
+	fet := newTestFet(t, &Config{Mode: types.Gofet}, nil)
+	assert.Equal(t, types.Gofet, fet.Mode)
+	result, err := fet.FetchString(`{%a = "gofet"%}{%a%}`, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "gofet", result)
+	// wrong mode
+	_, err = New(&Config{Mode: 3})
+	assert.NotNil(t, err)
+}
+
+func TestError(t *testing.T) {
+	fet, _ := New(&Config{
+		Mode:        types.Smarty,
+		TemplateDir: "tests/smarty/templates",
+	})
+	var fetErr *Error
+	// parse error
+	_, _, err := fet.CompileString("error.tpl", "hello\n  {%if $a%}")
+	assert.True(t, errors.As(err, &fetErr))
+	assert.Equal(t, fet.RealTmplPath("error.tpl"), fetErr.File)
+	assert.Equal(t, 2, fetErr.Line)
+	assert.Equal(t, 3, fetErr.Column)
+	assert.Equal(t, "if", fetErr.Tag)
+	assert.Equal(t, " 2 |   {%if $a%}\n   |   ^", fetErr.Excerpt())
+	// expression error
+	_, _, err = fet.CompileString("error.tpl", "hello\n{%$a = 1 + #%}")
+	assert.True(t, errors.As(err, &fetErr))
+	assert.Equal(t, 2, fetErr.Line)
+	assert.Equal(t, 12, fetErr.Column)
+	assert.Equal(t, " 2 | {%$a = 1 + #%}\n   |            ^", fetErr.Excerpt())
+	var expErr *expression.Error
+	assert.True(t, errors.As(err, &expErr))
+	// the errors of the generator and the expressions in the properties
+	for _, item := range []struct {
+		code   string
+		column int
+		tag    string
+	}{
+		{"hello\n  {%if 1 == 1 && $a@index%}{%/if%}", 18, "if"},
+		{"hello\n  {%for $i = 0; $i < $b@index; $i++%}{%/for%}", 22, "for"},
+		{"hello\n{%foreach $ROOT as $item%}{%$item@key%}{%/foreach%}", 29, ""},
+		{"hello\n  {%$b = \"ab`$a@index`\"%}", 14, "$b"},
+		{"hello\n  {%include \"hello.tpl\" a=1+%}", 29, "include"},
+	} {
+		_, _, err = fet.CompileString("error.tpl", item.code)
+		assert.True(t, errors.As(err, &fetErr), item.code)
+		assert.Equal(t, fet.RealTmplPath("error.tpl"), fetErr.File, item.code)
+		assert.Equal(t, 2, fetErr.Line, item.code)
+		assert.Equal(t, item.column, fetErr.Column, item.code)
+		assert.Equal(t, item.tag, fetErr.Tag, item.code)
+	}
+}
+
+func TestCollectErrors(t *testing.T) {
+	fsys := fstest.MapFS{
+		"index.tpl": {Data: []byte("{%capture %}x{%/capture%}\n{%$a = 1 + #%}\n{%include \"inc.tpl\"%}{%include \"inc.tpl\"%}")},
+		"inc.tpl":   {Data: []byte("{%foreach $list%}{%break%}{%/foreach%}\n{%$b = #%}")},
+	}
+	conf := &Config{
+		Mode:          types.Smarty,
+		TemplateDir:   "embed_templates",
+		Loader:        NewFSLoader(fsys),
+		CollectErrors: true,
+	}
+	fet, _ := New(conf)
+	_, _, err := fet.Compile("index.tpl", false)
+	var errs Errors
+	assert.True(t, errors.As(err, &errs))
+	assert.Equal(t, 4, len(errs))
+	lines := [][2]interface{}{}
+	for _, err := range errs {
+		var fetErr *Error
+		assert.True(t, errors.As(err, &fetErr))
+		lines = append(lines, [2]interface{}{fet.ShortTmplPath(fetErr.File), fetErr.Line})
+	}
+	assert.Equal(t, [][2]interface{}{
+		{"index.tpl", 1},
+		{"index.tpl", 2},
+		{"inc.tpl", 1},
+		{"inc.tpl", 2},
+	}, lines)
+	// match the errors in the list, call the methods directly since go1.20+ also unwraps the list
+	var fetErr *Error
+	assert.True(t, errs.As(&fetErr))
+	assert.Equal(t, 1, fetErr.Line)
+	var expErr *expression.Error
+	assert.True(t, errs.As(&expErr))
+	assert.True(t, errs.Is(expErr))
+	assert.False(t, errs.Is(ErrMaxIncludeDepth))
+	// stop at the first error
+	conf.CollectErrors = false
+	fet, _ = New(conf)
+	_, _, err = fet.Compile("index.tpl", false)
+	assert.False(t, errors.As(err, &errs))
+	// unrecoverable errors
+	conf.CollectErrors = true
+	fet, _ = New(conf)
+	_, _, err = fet.CompileString("", "{%capture %}x{%/capture%}{%/foreach%}")
+	assert.True(t, errors.As(err, &errs))
+	assert.Equal(t, 2, len(errs))
+}
+
+func TestCompileAll(t *testing.T) {
+	conf := &Config{
+		Mode:        types.Smarty,
+		TemplateDir: "tests/smarty/templates",
+		CompileDir:  t.TempDir(),
+		Ignores:     []string{"inc"},
+		UcaseField:  true,
+		AutoRoot:    true,
+		Parallel:    2,
+	}
+	fet, _ := New(conf)
+	result, err := fet.CompileAll()
+	assert.Nil(t, err)
+	files, _ := fet.GetCompileFiles(fet.TemplateDir)
+	assert.Equal(t, len(files), len(result.Files))
+	assert.True(t, sort.StringsAreSorted(result.Files))
+	for _, tpl := range result.Files {
+		_, err := os.Stat(fet.RealCmplPath(tpl))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, []string{fet.RealTmplPath("inc/header.tpl"), fet.RealTmplPath("inc/footer.tpl")}, result.Deps[fet.RealTmplPath("include.tpl")])
+	// cancel
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err = fet.CompileAllContext(ctx)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, 0, len(result.Files))
+}
+
+func TestIncrementalCompile(t *testing.T) {
+	conf := &Config{
+		Ignores:     []string{"inc"},
+		Incremental: true,
+	}
+	fet := newTestFet(t, conf, map[string]string{
+		"index.tpl":      `{%extends "inc/base.tpl"%}{%block "content"%}index{%/block%}`,
+		"about.tpl":      `{%include "inc/header.tpl"%}about`,
+		"hello.tpl":      `hello`,
+		"inc/base.tpl":   `{%include "inc/header.tpl"%}{%block "content"%}{%/block%}`,
+		"inc/header.tpl": `header`,
+	})
+	shortPaths := func(files []string) []string {
+		result := []string{}
+		for _, file := range files {
+			result = append(result, fet.ShortTmplPath(file))
+		}
+		return result
+	}
+	result, err := fet.CompileAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"about.tpl", "hello.tpl", "index.tpl"}, shortPaths(result.Files))
+	// nothing changed
+	result, err = fet.CompileAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, shortPaths(result.Files))
+	assert.Equal(t, []string{"about.tpl", "hello.tpl", "index.tpl"}, shortPaths(result.Skipped))
+	assert.Equal(t, []string{"index.tpl", "inc/base.tpl", "inc/header.tpl"}, shortPaths(result.Deps[fet.RealTmplPath("index.tpl")]))
+	// transitive dependency changed
+	fet.writeTpl("inc/header.tpl", `new header`)
+	result, err = fet.CompileAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"about.tpl", "index.tpl"}, shortPaths(result.Files))
+	// the source changed
+	fet.writeTpl("hello.tpl", `new hello`)
+	result, err = fet.CompileAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"hello.tpl"}, shortPaths(result.Files))
+	// the compiled file is removed
+	assert.Nil(t, os.Remove(fet.RealCmplPath("about.tpl")))
+	result, err = fet.CompileAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"about.tpl"}, shortPaths(result.Files))
+	// the config changed
+	conf.UcaseField = true
+	fet = newTestFet(t, conf, nil)
+	result, err = fet.CompileAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"about.tpl", "hello.tpl", "index.tpl"}, shortPaths(result.Files))
+	// the funcs and the custom tags changed
+	assert.Nil(t, fet.AddFunc("shout", strings.ToUpper))
+	result, err = fet.CompileAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"about.tpl", "hello.tpl", "index.tpl"}, shortPaths(result.Files))
+	assert.Nil(t, fet.AddTag("noop", &Tag{Compile: func(ctx *TagContext) (string, error) { return "", nil }}))
+	result, err = fet.CompileAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"about.tpl", "hello.tpl", "index.tpl"}, shortPaths(result.Files))
+	result, err = fet.CompileAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, shortPaths(result.Files))
+	// the implementations changed with the version
+	conf.Version = "1.0.1"
+	fet = newTestFet(t, conf, nil)
+	assert.Nil(t, fet.AddFunc("shout", strings.ToUpper))
+	assert.Nil(t, fet.AddTag("noop", &Tag{Compile: func(ctx *TagContext) (string, error) { return "", nil }}))
+	result, err = fet.CompileAll()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"about.tpl", "hello.tpl", "index.tpl"}, shortPaths(result.Files))
+}
+
+func TestWatch(t *testing.T) {
+	fet := newTestFet(t, &Config{
+		Ignores:       []string{"inc"},
+		WatchInterval: 10,
+	}, map[string]string{
+		"index.tpl":      `{%extends "inc/base.tpl"%}{%block "content"%}index{%/block%}`,
+		"hello.tpl":      `hello`,
+		"inc/base.tpl":   `{%include "inc/header.tpl"%}{%block "content"%}{%/block%}`,
+		"inc/header.tpl": `header`,
+	})
+	type watchResult struct {
+		files []string
+		err   error
+	}
+	results := make(chan watchResult)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- fet.Watch(ctx, func(files []string, err error) {
+			shortFiles := []string{}
+			for _, file := range files {
+				shortFiles = append(shortFiles, fet.ShortTmplPath(file))
+			}
+			results <- watchResult{shortFiles, err}
+		})
+	}()
+	next := func() watchResult {
+		select {
+		case result := <-results:
+			return result
+		case <-time.After(5 * time.Second):
+			t.Fatal("wait for watch timeout")
+		}
+		return watchResult{}
+	}
+	// compile all at first
+	result := next()
+	assert.Nil(t, result.err)
+	assert.Equal(t, []string{"hello.tpl", "index.tpl"}, result.files)
+	// transitive dependency changed
+	fet.writeTpl("inc/header.tpl", `new header`)
+	result = next()
+	assert.Nil(t, result.err)
+	assert.Equal(t, []string{"index.tpl"}, result.files)
+	// the template has errors
+	fet.writeTpl("hello.tpl", `{%capture %}`)
+	result = next()
+	assert.NotNil(t, result.err)
+	assert.Equal(t, []string{}, result.files)
+	// the failed template is fixed
+	fet.writeTpl("hello.tpl", `new hello`)
+	result = next()
+	assert.Nil(t, result.err)
+	assert.Equal(t, []string{"hello.tpl"}, result.files)
+	// new template added
+	fet.writeTpl("about.tpl", `{%include "inc/header.tpl"%}about`)
+	result = next()
+	assert.Nil(t, result.err)
+	assert.Equal(t, []string{"about.tpl"}, result.files)
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+}
+
+func TestExecLimits(t *testing.T) {
+	fet := newTestFet(t, &Config{
+		MaxLoopIterations:  3,
+		MaxTotalIterations: 10,
+		MaxOutputBytes:     8,
+		MaxIncludeDepth:    1,
+	}, map[string]string{
+		"foreach.tpl":  "{%foreach $ROOT as $item%}{%$item%}{%/foreach%}",
+		"endless.tpl":  "\n {%for $i = 0; $i >= 0; $i++%}{%/for%}",
+		"nested.tpl":   `{%foreach $ROOT as $a%}{%foreach $ROOT as $b%}{%$b%}{%/foreach%}{%/foreach%}`,
+		"include.tpl":  `{%include "include1.tpl"%}`,
+		"include1.tpl": `{%include "include2.tpl"%}`,
+		"include2.tpl": `include`,
+		"output.tpl":   `{%$ROOT%}`,
+	})
+	var limitErr *Error
+	// max iterations of a loop
+	fet.assertOutputToBe("foreach.tpl", []int{1, 2, 3}, "123")
+	_, err := fet.Fetch("foreach.tpl", []int{1, 2, 3, 4})
+	assert.True(t, errors.Is(err, ErrMaxLoopIterations))
+	_, err = fet.Fetch("endless.tpl", nil)
+	assert.True(t, errors.Is(err, ErrMaxLoopIterations))
+	assert.True(t, errors.As(err, &limitErr))
+	assert.Equal(t, "endless.tpl", limitErr.File)
+	assert.Equal(t, 2, limitErr.Line)
+	assert.Equal(t, 2, limitErr.Column)
+	assert.Equal(t, "for", limitErr.Tag)
+	// max total iterations
+	_, err = fet.Fetch("nested.tpl", []int{1, 2, 3})
+	assert.True(t, errors.Is(err, ErrMaxTotalIterations))
+	fet.assertOutputToBe("nested.tpl", []int{1, 2}, "1212")
+	// max include depth
+	_, err = fet.Fetch("include.tpl", nil)
+	assert.True(t, errors.Is(err, ErrMaxIncludeDepth))
+	assert.True(t, errors.As(err, &limitErr))
+	assert.Equal(t, "include1.tpl", limitErr.File)
+	assert.Equal(t, 1, limitErr.Line)
+	assert.Equal(t, 1, limitErr.Column)
+	assert.Equal(t, "include", limitErr.Tag)
+	// the limits are checked when rendering the files compiled without them
+	noLimits := newTestFet(t, &Config{
+		TemplateDir: fet.TemplateDir,
+		CompileDir:  fet.CompileDir,
+	}, nil)
+	// the iterations are not counted without the limits and the ctx
+	limit, _ := noLimits.newLoopLimit(context.Background(), "foreach.tpl", 1, 1, "foreach")
+	assert.Nil(t, limit)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	limit, _ = noLimits.newLoopLimit(ctx, "foreach.tpl", 1, 1, "foreach")
+	assert.NotNil(t, limit)
+	for _, tpl := range []string{"foreach.tpl", "include.tpl"} {
+		_, _, err = noLimits.Compile(tpl, true)
+		assert.Nil(t, err)
+		assert.Nil(t, noLimits.Display(tpl, []int{1, 2, 3, 4}, new(bytes.Buffer)))
+	}
+	err = fet.Display("foreach.tpl", []int{1, 2, 3, 4}, new(bytes.Buffer))
+	assert.True(t, errors.Is(err, ErrMaxLoopIterations))
+	err = fet.Display("include.tpl", nil, new(bytes.Buffer))
+	assert.True(t, errors.Is(err, ErrMaxIncludeDepth))
+	// max output bytes
+	_, err = fet.Fetch("output.tpl", "123456789")
+	assert.True(t, errors.Is(err, ErrMaxOutputBytes))
+	assert.Equal(t, "[file:'output.tpl'][error]"+ErrMaxOutputBytes.Error()+":8", err.Error())
+	// the limits of the template source code
+	_, err = fet.FetchString(`{%$ROOT%}`, "123456789")
+	assert.True(t, errors.Is(err, ErrMaxOutputBytes))
+	_, err = fet.FetchString(`{%foreach $ROOT as $a%}{%foreach $ROOT as $b%}{%/foreach%}{%/foreach%}`, []int{1, 2, 3})
+	assert.True(t, errors.Is(err, ErrMaxTotalIterations))
+	result, err := fet.FetchString(`{%foreach $ROOT as $a%}{%$a%}{%/foreach%}`, []int{1, 2, 3})
+	assert.Nil(t, err)
+	assert.Equal(t, "123", result)
+}
+
+func TestAddFunc(t *testing.T) {
+	fet := newTestFet(t, nil, nil)
+	assert.Nil(t, fet.AddFunc("money", func(num float64, symbol string) string {
+		return fmt.Sprintf("%s%.2f", symbol, num)
+	}))
+	assert.Nil(t, fet.Funcs(template.FuncMap{
+		"asset_url": func(file string) string {
+			return "/static/" + file
+		},
+		"lang": func(ctx context.Context) string {
+			if lang, ok := ctx.Value("lang").(string); ok {
+				return lang
+			}
+			return "en"
+		},
+	}))
+	result, err := fet.FetchString(`{%money(1.5, "$")%}|{%$ROOT.Price|money:"¥"%}|{%"app.js"|asset_url%}|{%lang()%}`, map[string]float64{
+		"Price": 10,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "$1.50|¥10.00|/static/app.js|en", result)
+	// invalid funcs
+	assert.NotNil(t, fet.AddFunc("INJECT_PLUS", strings.ToUpper))
+	assert.NotNil(t, fet.AddFunc("true", strings.ToUpper))
+	assert.NotNil(t, fet.AddFunc("and", strings.ToUpper))
+	assert.NotNil(t, fet.AddFunc("$upper", strings.ToUpper))
+	assert.NotNil(t, fet.AddFunc("upper", "upper"))
+	assert.NotNil(t, fet.AddFunc("upper", func() {}))
+}
+
+func TestAddTag(t *testing.T) {
+	fet := newTestFet(t, nil, nil)
+	// single tag
+	assert.Nil(t, fet.AddTag("asset", &Tag{
+		DefaultProp: "file",
+		Props: map[string]bool{
+			"file":    true,
+			"version": false,
+		},
+		Compile: func(ctx *TagContext) (string, error) {
+			code := "{{print \"/static/\" " + ctx.Props["file"]
+			if version, ok := ctx.Props["version"]; ok {
+				code += " \"?v=\" " + version
+			}
+			return code + "}}", nil
+		},
+	}))
+	// block tag
+	assert.Nil(t, fet.AddTag("when", &Tag{
+		Block:      true,
+		Expression: true,
+		Compile: func(ctx *TagContext) (string, error) {
+			return "{{if " + ctx.Expression + "}}", nil
+		},
+	}))
+	// block tag without properties
+	assert.Nil(t, fet.AddTag("hidden", &Tag{
+		Block: true,
+		Compile: func(ctx *TagContext) (string, error) {
+			return "{{if false}}", nil
+		},
+		CompileEnd: func(ctx *TagContext) (string, error) {
+			return "{{end}}", nil
+		},
+	}))
+	data := map[string]interface{}{
+		"Show":    true,
+		"Version": 2,
+	}
+	result, err := fet.FetchString(`{%asset "app.js"%}|{%asset file="app.css" version=$ROOT.Version%}`, data)
+	assert.Nil(t, err)
+	assert.Equal(t, "/static/app.js|/static/app.css?v=2", result)
+	result, err = fet.FetchString(`{%when $ROOT.Show%}show{%hidden%}hidden{%/hidden%}{%/when%}{%when !$ROOT.Show%}hide{%/when%}`, data)
+	assert.Nil(t, err)
+	assert.Equal(t, "show", result)
+	// wrong properties
+	_, err = fet.FetchString(`{%asset "app.js" name="app"%}`, data)
+	assert.NotNil(t, err)
+	_, err = fet.FetchString(`{%asset version=1%}`, data)
+	assert.NotNil(t, err)
+	_, err = fet.FetchString(`{%when $ROOT.Show%}show`, data)
+	assert.NotNil(t, err)
+	_, err = fet.FetchString(`{%when%}show{%/when%}`, data)
+	assert.NotNil(t, err)
+	// the cached templates use the tag registered again
+	fet.writeTpl("asset.tpl", `{%asset "app.js"%}`)
+	fet.assertOutputToBe("asset.tpl", nil, "/static/app.js")
+	assert.Nil(t, fet.AddTag("asset", &Tag{
+		DefaultProp: "file",
+		Compile: func(ctx *TagContext) (string, error) {
+			return "{{print \"/assets/\" " + ctx.Props["file"] + "}}", nil
+		},
+	}))
+	fet.assertOutputToBe("asset.tpl", nil, "/assets/app.js")
+	// wrong tags
+	assert.NotNil(t, fet.AddTag("include", &Tag{Compile: func(ctx *TagContext) (string, error) { return "", nil }}))
+	assert.NotNil(t, fet.AddTag("cache", &Tag{}))
+	assert.NotNil(t, fet.AddTag("literal", &Tag{Compile: func(ctx *TagContext) (string, error) { return "", nil }}))
+	// the variables declared in the template shadow the tag in Gofet mode
+	gofet := newTestFet(t, &Config{Mode: types.Gofet}, nil)
+	assert.Nil(t, gofet.AddTag("asset", &Tag{
+		DefaultProp: "file",
+		Compile: func(ctx *TagContext) (string, error) {
+			return "{{print \"/static/\" " + ctx.Props["file"] + "}}", nil
+		},
+	}))
+	data = map[string]interface{}{
+		"asset": "root",
+		"list":  []string{"a", "b"},
+	}
+	result, err = gofet.FetchString(`{%asset "app.js"%}|{%ROOT.asset%}|{%for asset in ROOT.list%}{%asset%}{%/for%}|{%asset = 1%}{%asset%}`, data)
+	assert.Nil(t, err)
+	assert.Equal(t, "/static/app.js|root|ab|1", result)
+}
+
+func TestFunction(t *testing.T) {
+	fet := newTestFet(t, nil, nil)
+	type Item struct {
+		Name     string
+		Children []Item
+	}
+	data := map[string]interface{}{
+		"Title": "menu",
+		"Menu": []Item{
+			{Name: "a", Children: []Item{{Name: "a1"}, {Name: "a2"}}},
+			{Name: "b"},
+		},
+	}
+	// recursion
+	result, err := fet.FetchString(`{%function name="menu" items=null level=0%}`+
+		`<ul class="level{%$level%}">{%foreach $items as $item%}<li>{%$item.Name%}`+
+		`{%if count($item.Children) > 0%}{%menu items=$item.Children level=$level+1%}{%/if%}</li>{%/foreach%}</ul>`+
+		`{%/function%}{%call name="menu" items=$ROOT.Menu%}`, data)
+	assert.Nil(t, err)
+	assert.Equal(t, `<ul class="level0"><li>a<ul class="level1"><li>a1</li><li>a2</li></ul></li><li>b</li></ul>`, result)
+	// default arguments and the root data
+	result, err = fet.FetchString(`{%function "title" prefix="#"%}{%$prefix%}{%$ROOT.Title%}{%/function%}{%title%}|{%title prefix="@"%}`, data)
+	assert.Nil(t, err)
+	assert.Equal(t, "#menu|@menu", result)
+	// call the function before defined
+	result, err = fet.FetchString(`{%title%}|{%title prefix="@"%}{%function "title" prefix="#"%}{%$prefix%}{%$ROOT.Title%}{%/function%}`, data)
+	assert.Nil(t, err)
+	assert.Equal(t, "#menu|@menu", result)
+	// call the function defined in the include file
+	fet.writeTpl("title.tpl", `{%function "title" prefix="#"%}{%$prefix%}{%$ROOT.Title%}{%/function%}`)
+	fet.writeTpl("call.tpl", `{%include "title.tpl"%}{%title%}|{%title prefix="@"%}`)
+	fet.assertOutputToBe("call.tpl", data, "#menu|@menu")
+	// the file defines the function is included more than once
+	fet.writeTpl("header.tpl", `{%include "title.tpl"%}<h1>{%title%}</h1>`)
+	fet.writeTpl("footer.tpl", `{%include "title.tpl"%}<p>{%title prefix="@"%}</p>`)
+	fet.writeTpl("page.tpl", `{%include "header.tpl"%}{%include "footer.tpl"%}`)
+	fet.assertOutputToBe("page.tpl", data, "<h1>#menu</h1><p>@menu</p>")
+	// the file defines the function is included in the block tags
+	fet.writeTpl("block.tpl", `{%if $ROOT.Title%}{%foreach $ROOT.Menu as $item%}{%include "title.tpl"%}{%/foreach%}{%/if%}{%title%}`)
+	fet.assertOutputToBe("block.tpl", data, "#menu")
+	// the function in Glob mode
+	globFet := newTestFet(t, &Config{Glob: true}, map[string]string{
+		"title.tpl": `{%function "title" prefix="#"%}{%$prefix%}{%$ROOT.Title%}{%/function%}`,
+	})
+	code, _, err := globFet.CompileString("call.tpl", `{%include "title.tpl"%}{%title%}|{%title prefix="@"%}`)
+	assert.Nil(t, err)
+	tmpl, _ := globFet.tmpl.Clone()
+	tmpl, err = tmpl.Parse(code)
+	assert.Nil(t, err)
+	buf := new(bytes.Buffer)
+	assert.Nil(t, tmpl.ExecuteTemplate(buf, "call", data))
+	assert.Equal(t, "#menu|@menu", buf.String())
+	// the variables out of the function are not visible
+	_, err = fet.FetchString(`{%$a = 1%}{%function name="show"%}{%$a%}{%/function%}{%show%}`, data)
+	assert.NotNil(t, err)
+	// wrong function tags
+	_, err = fet.FetchString(`{%if true%}{%function name="show"%}{%/function%}{%/if%}`, data)
+	assert.NotNil(t, err)
+	_, err = fet.FetchString(`{%function name="include"%}{%/function%}`, data)
+	assert.NotNil(t, err)
+}
+
+func TestBlockParent(t *testing.T) {
+	fet := newTestFet(t, nil, map[string]string{
+		"base.tpl":    `<head>{%block "head"%}<base>{%/block%}</head>{%block "body"%}{%$fet.block.parent%}body{%/block%}`,
+		"parent.tpl":  `{%extends "base.tpl"%}{%block "head"%}[{%$fet.block.parent%}]{%/block%}`,
+		"append.tpl":  `{%extends "base.tpl"%}{%block "head" append%}<link>{%/block%}`,
+		"prepend.tpl": `{%extends "base.tpl"%}{%block name="head" prepend%}<meta>{%/block%}`,
+		"replace.tpl": `{%extends "base.tpl"%}{%block "head"%}<title>t</title>{%/block%}`,
+	})
+	fet.assertOutputToBe("base.tpl", nil, "<head><base></head>body")
+	fet.assertOutputToBe("parent.tpl", nil, "<head>[<base>]</head>body")
+	fet.assertOutputToBe("append.tpl", nil, "<head><base><link></head>body")
+	fet.assertOutputToBe("prepend.tpl", nil, "<head><meta><base></head>body")
+	fet.assertOutputToBe("replace.tpl", nil, "<head><title>t</title></head>body")
+}
+
+func TestMultiLevelExtends(t *testing.T) {
+	fet := newTestFet(t, nil, map[string]string{
+		"base.tpl": `<title>{%block "title"%}base{%/block%}</title>` +
+			`{%block "body"%}<header>{%block "header"%}header{%/block%}</header><main>{%block "main"%}main{%/block%}</main>{%/block%}` +
+			`{%block "footer"%}footer{%/block%}`,
+		"layout.tpl": `{%extends "base.tpl"%}{%block "title"%}layout-{%$fet.block.parent%}{%/block%}` +
+			`{%block "main"%}<aside>{%block "aside"%}aside{%/block%}</aside>{%block "content"%}content{%/block%}{%/block%}` +
+			`{%block "footer" append%}-layout{%/block%}`,
+		"page.tpl": `{%extends "layout.tpl"%}{%block "title"%}page-{%$fet.block.parent%}{%/block%}` +
+			`{%block "content"%}page{%/block%}{%block "header"%}page-header{%/block%}{%block "footer" append%}-page{%/block%}`,
+		"detail.tpl": `{%extends "page.tpl"%}{%block "aside" prepend%}detail-{%/block%}{%block "content"%}detail-{%$fet.block.parent%}{%/block%}`,
+		// the block can't be nested in other tags
+		"wrong.tpl": `{%if true%}{%block "title"%}{%/block%}{%/if%}`,
+	})
+	fet.assertOutputToBe("layout.tpl", nil, "<title>layout-base</title><header>header</header><main><aside>aside</aside>content</main>footer-layout")
+	fet.assertOutputToBe("page.tpl", nil, "<title>page-layout-base</title><header>page-header</header><main><aside>aside</aside>page</main>footer-layout-page")
+	fet.assertOutputToBe("detail.tpl", nil, "<title>page-layout-base</title><header>page-header</header><main><aside>detail-aside</aside>detail-page</main>footer-layout-page")
+	_, err := fet.Fetch("wrong.tpl", nil)
+	assert.NotNil(t, err)
+}
+
+func TestWhile(t *testing.T) {
+	fet := newTestFet(t, &Config{
+		MaxLoopIterations: 10,
+	}, map[string]string{
+		"while.tpl":    `{%$i = $ROOT%}{%while $i > 0%}{%$i%}{%$i = $i - 1%}{%/while%}`,
+		"break.tpl":    `{%$i = 0%}{%while true%}{%$i = $i + 1%}{%if $i > 3%}{%break%}{%/if%}{%$i%}{%/while%}`,
+		"continue.tpl": `{%$i = 0%}{%while $i < 5%}{%$i = $i + 1%}{%if $i % 2 == 0%}{%continue%}{%/if%}{%$i%}{%/while%}`,
+		"nested.tpl":   `{%foreach $ROOT as $item%}{%$j = $item%}{%while $j > 0%}{%$item%}{%$j = $j - 1%}{%/while%}{%/foreach%}`,
+		"endless.tpl":  `{%while true%}{%/while%}`,
+		"wrong.tpl":    `{%while%}{%/while%}`,
+	})
+	fet.assertOutputToBe("while.tpl", 3, "321")
+	fet.assertOutputToBe("break.tpl", nil, "123")
+	fet.assertOutputToBe("continue.tpl", nil, "135")
+	fet.assertOutputToBe("nested.tpl", []int{1, 2}, "122")
+	_, err := fet.Fetch("endless.tpl", nil)
+	assert.True(t, errors.Is(err, ErrMaxLoopIterations))
+	_, err = fet.Fetch("wrong.tpl", nil)
+	assert.NotNil(t, err)
+}
+
+func TestLoopElse(t *testing.T) {
+	fet := newTestFet(t, nil, map[string]string{
+		"foreach.tpl": `{%foreach $ROOT as $item%}{%$item%}{%foreachelse%}empty{%/foreach%}`,
+		"for.tpl":     `{%for $i = 0; $i < $ROOT; $i++%}{%$i%}{%forelse%}empty{%/for%}`,
+		"break.tpl":   `{%for $i = 0; $i < 5; $i++%}{%if $i == $ROOT%}{%break%}{%/if%}{%$i%}{%forelse%}empty{%/for%}`,
+		"nested.tpl":  `{%foreach $ROOT as $list%}[{%foreach $list as $item%}{%$item%}{%foreachelse%}{%continue%}{%/foreach%}]{%/foreach%}`,
+	})
+	fet.assertOutputToBe("foreach.tpl", []int{1, 2}, "12")
+	fet.assertOutputToBe("foreach.tpl", []int{}, "empty")
+	fet.assertOutputToBe("for.tpl", 3, "012")
+	fet.assertOutputToBe("for.tpl", 0, "empty")
+	fet.assertOutputToBe("break.tpl", 2, "01")
+	fet.assertOutputToBe("break.tpl", 0, "")
+	fet.assertOutputToBe("nested.tpl", [][]int{{1}, {}, {2}}, "[1][[2]")
+	// wrong usages
+	for _, code := range []string{
+		`{%foreach $ROOT as $item%}{%forelse%}{%/foreach%}`,
+		`{%for $i = 0; $i < 1; $i++%}{%foreachelse%}{%/for%}`,
+		`{%foreach $ROOT as $item%}{%foreachelse%}{%foreachelse%}{%/foreach%}`,
+		`{%if true%}{%foreachelse%}{%/if%}`,
+	} {
+		fet.writeTpl("wrong.tpl", code)
+		_, err := fet.Fetch("wrong.tpl", nil)
+		assert.NotNil(t, err, code)
+	}
+	// Gofet mode
+	fet = newTestFet(t, &Config{Mode: types.Gofet}, map[string]string{
+		"gofet.tpl": `{%for item in ROOT%}{%item%}{%forelse%}empty{%/for%}`,
+	})
+	fet.assertOutputToBe("gofet.tpl", []string{}, "empty")
+}
+
+func TestLoopMeta(t *testing.T) {
+	fet := newTestFet(t, nil, map[string]string{
+		"foreach.tpl": `{%foreach $ROOT as $item%}{%if $item@first%}[{%/if%}{%$item@index%}:{%$item@iteration%}/{%$item@total%}{%if $item@last%}]{%else%},{%/if%}{%/foreach%}`,
+		"map.tpl":     `{%foreach $ROOT as $key => $value%}{%$key%}{%if !$value@last%},{%/if%}{%/foreach%}`,
+		"named.tpl":   `{%foreach $ROOT as $list name="outer"%}{%foreach $list as $item%}{%$fet.foreach.outer.index%}-{%$item@index%}{%if !$fet.foreach.outer.last || !$item@last%},{%/if%}{%/foreach%}{%/foreach%}`,
+		"for.tpl":     `{%for $i = 10; $i > 0; $i -= 3%}{%if !$i@first%},{%/if%}{%$i@iteration%}{%/for%}`,
+		"inc.tpl":     `{%$item@index%}{%if !$fet.foreach.list.last%},{%/if%}`,
+		"include.tpl": `{%foreach $ROOT as $item name="list"%}{%include "inc.tpl"%}{%/foreach%}`,
+	})
+	fet.assertOutputToBe("foreach.tpl", []string{"a", "b", "c"}, "[0:1/3,1:2/3,2:3/3]")
+	fet.assertOutputToBe("map.tpl", map[string]int{"a": 1, "b": 2}, "a,b")
+	fet.assertOutputToBe("named.tpl", [][]int{{1, 2}, {3}}, "0-0,0-1,1-0")
+	fet.assertOutputToBe("for.tpl", nil, "1,2,3,4")
+	// used in the include file
+	fet.assertOutputToBe("include.tpl", []string{"a", "b"}, "0,1")
+	// wrong usages
+	for _, code := range []string{
+		`{%$a = 1%}{%$a@index%}`,
+		`{%foreach $ROOT as $item%}{%$item@key%}{%/foreach%}`,
+		`{%for $i = 0; $i < 1; $i++%}{%$i@last%}{%/for%}`,
+		`{%foreach $ROOT as $item name="loop"%}{%/foreach%}{%$fet.foreach.loop.index%}`,
+		`{%foreach $ROOT as $item%}{%/foreach%}{%$item@index%}`,
+	} {
+		fet.writeTpl("wrong.tpl", code)
+		_, err := fet.Fetch("wrong.tpl", nil)
+		assert.NotNil(t, err, code)
+	}
+	// Gofet mode
+	fet = newTestFet(t, &Config{Mode: types.Gofet}, map[string]string{
+		"gofet.tpl": `{%for item, key in ROOT name="list"%}{%item@index%}{%if !$fet.foreach.list.last%},{%/if%}{%/for%}`,
+		"text.tpl":  `{%for item in ROOT%}item@example.com{%/for%}`,
+	})
+	fet.assertOutputToBe("gofet.tpl", []string{"a", "b"}, "0,1")
+	// the loop properties are not kept if not used
+	fet.assertOutputToBe("text.tpl", []string{"a"}, "item@example.com")
+	code, _, err := fet.Compile("text.tpl", false)
+	assert.Nil(t, err)
+	assert.NotContains(t, code, "INJECT_LOOP_META")
+}
+
+func TestTrimSpaces(t *testing.T) {
+	fet := newTestFet(t, nil, map[string]string{
+		"trim.tpl":  "<ul>\n  {%- foreach $ROOT as $item -%}\n  <li>{%- $item -%}</li>\n  {%- /foreach -%}\n</ul>",
+		"minus.tpl": "{%$a = 3%}{%$a -1%} {%$a-1%} {%-1%}",
+	})
+	fet.assertOutputToBe("trim.tpl", []int{1, 2}, "<ul><li>1</li><li>2</li></ul>")
+	// the minus operator is not the trim marker
+	fet.assertOutputToBe("minus.tpl", nil, "2 2 -1")
+	// remove the newline after the block tags
+	fet = newTestFet(t, &Config{
+		LeftDelimiter:  "<%",
+		RightDelimiter: "%>",
+		TrimBlocks:     true,
+	}, map[string]string{
+		"blocks.tpl":     "<ul>\n<%foreach $ROOT as $item%>\n  <li><%$item%></li>\n<%/foreach%>\n</ul>\r\n<%if true%>\r\nok<%/if%>\n",
+		"delimiters.tpl": "<ul>\n  <%- foreach $ROOT as $item -%>\n  <li><%$item%></li>\n<%- /foreach%>\n</ul>",
+	})
+	fet.assertOutputToBe("blocks.tpl", []int{1, 2}, "<ul>\n  <li>1</li>\n  <li>2</li>\n</ul>\r\nok")
+	fet.assertOutputToBe("delimiters.tpl", []int{1, 2}, "<ul><li>1</li><li>2</li></ul>")
+}
+
+func TestLiteral(t *testing.T) {
+	fet := newTestFet(t, nil, map[string]string{
+		"literal.tpl":  "{%$ROOT%}{%literal%}<div>{{ message }} {%$ROOT%} {%if%}</div>{% /literal %}\n{%$ROOT%}",
+		"unclosed.tpl": "{%literal%}{%$ROOT%}{%/if%}",
+	})
+	fet.assertOutputToBe("literal.tpl", "a", "a<div>{{ message }} {%$ROOT%} {%if%}</div>\na")
+	_, err := fet.Fetch("unclosed.tpl", "a")
+	assert.NotNil(t, err)
+	// the literal block with "{{" delimiters and the line numbers after it
+	fet = newTestFet(t, &Config{
+		LeftDelimiter:  "{{",
+		RightDelimiter: "}}",
+		TrimBlocks:     true,
+	}, map[string]string{
+		"delimiters.tpl": "{{literal}}\n{{ message }}\n{{/literal}}\n{{$ROOT}}\n{{if}}",
+	})
+	_, err = fet.Fetch("delimiters.tpl", "a")
+	var tplErr *Error
+	assert.True(t, errors.As(err, &tplErr))
+	assert.Equal(t, 5, tplErr.Line)
+	fet.writeTpl("delimiters.tpl", "{{literal}}\n{{ message }}\n{{/literal}}\n{{$ROOT}}")
+	fet.assertOutputToBe("delimiters.tpl", "a", "{{ message }}\na")
+	// only the raw text may contain the "{{" delimiters, it's escaped
+	code, _, err := fet.CompileString("", "{{literal}}{{ message }}{{/literal}} }}")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(code, `{{"{{"}} message }} }}`))
+}
+
+func TestStrip(t *testing.T) {
+	fet := newTestFet(t, nil, map[string]string{
+		"strip.tpl": "{%strip%}\n<ul class=\"list\">\n  {%foreach $ROOT as $item%}\n    <li>{%$item%} item</li>\n  {%/foreach%}\r\n</ul>\n" +
+			"{%literal%}\n<pre>\n  {{ message }}\n</pre>\n{%/literal%}\n{%/strip%}\n<p>\n</p>",
+		"wrong.tpl": "{%strip true%}{%/strip%}",
+	})
+	fet.assertOutputToBe("strip.tpl", []int{1, 2}, "<ul class=\"list\"><li>1 item</li><li>2 item</li></ul>\n<pre>\n  {{ message }}\n</pre>\n\n<p>\n</p>")
+	_, err := fet.Fetch("wrong.tpl", nil)
+	assert.NotNil(t, err)
+}
+
+func TestMinify(t *testing.T) {
+	fet := newTestFet(t, &Config{
+		Minify: true,
+	}, map[string]string{
+		"minify.tpl": "<!-- comment -->\n<div   class=\"box\">\n  <!--[if IE]>ie<![endif]-->\n  <span>{%$ROOT%}</span>\n" +
+			"  <pre>\n  {%$ROOT%}\n  </pre>\n  <textarea name=\"{%$ROOT%}\">  a\n  b  </textarea>\n" +
+			"  <script>\n  var a = 1;\n  </script>\n  {%literal%}  <b>  literal  </b>  {%/literal%}\n</div>",
+	})
+	fet.assertOutputToBe("minify.tpl", "x", " <div class=\"box\"> <!--[if IE]>ie<![endif]--> <span>x</span> <pre>\n  x\n  </pre> "+
+		"<textarea name=\"x\">  a\n  b  </textarea> <script>\n  var a = 1;\n  </script>   <b>  literal  </b>   </div>")
+	// the spaces in the attribute values are kept
+	fet.writeTpl("attr.tpl", "<p  title=\"a   b\"\n  data-x='{%$ROOT%}   y'>  c  </p>")
+	fet.assertOutputToBe("attr.tpl", "x", "<p title=\"a   b\" data-x='x   y'> c </p>")
+	// the conditional comments are kept
+	fet.writeTpl("cond.tpl", "<!--[if !IE]><!-->  <p>{%$ROOT%}</p>  <!--<![endif]-->\n<!--[if lt IE 9]>\n  <p>ie</p>\n<![endif]-->")
+	fet.assertOutputToBe("cond.tpl", "x", "<!--[if !IE]><!--> <p>x</p> <!--<![endif]--> <!--[if lt IE 9]>\n  <p>ie</p>\n<![endif]-->")
+	state := &minifyState{}
+	text := minifyHTML("<p>\n  a <!--\n comment --> </p>", state)
+	assert.Equal(t, minifyState{}, *state)
+	assert.Equal(t, "<p> a </p>", text)
+	text = minifyHTML("<a href=\"  x", state)
+	assert.Equal(t, minifyState{inTag: true, quote: '"'}, *state)
+	assert.Equal(t, "<a href=\"  x", text)
+}
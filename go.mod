@@ -1,10 +1,15 @@
 module github.com/fefit/fet
 
-go 1.14
+go 1.18
 
 require (
-	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/fefit/dateutil v0.0.3
 	github.com/stretchr/testify v1.7.0
-	golang.org/x/text v0.8.0 // indirect
+	golang.org/x/text v0.8.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
 )
@@ -0,0 +1,151 @@
+package fet
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+)
+
+// the manifest file name in the compile directory
+const manifestName = ".fet-manifest.json"
+
+// compileManifest keep the dependencies and the source hashes of the compiled templates,
+// the paths are relative to the template directory
+type compileManifest struct {
+	// the hash of the config, all the files should be compiled again if it's changed
+	Config string              `json:"config"`
+	Hashes map[string]string   `json:"hashes"`
+	Deps   map[string][]string `json:"deps"`
+	// the current hashes of the source files
+	hashes map[string]string
+}
+
+// the hash of the config options, the custom tags and the funcs, they affect the compiled result
+func (fet *Fet) configHash() string {
+	conf := *fet.Config
+	conf.Parallel = 0
+	conf.Incremental = false
+	conf.CollectErrors = false
+	conf.WatchInterval = 0
+	conf.CacheCheckInterval = 0
+	// the limits are checked when rendering
+	conf.MaxLoopIterations = 0
+	conf.MaxTotalIterations = 0
+	conf.MaxOutputBytes = 0
+	conf.MaxIncludeDepth = 0
+	tags := []string{}
+	for name := range fet.tags {
+		tags = append(tags, name)
+	}
+	sort.Strings(tags)
+	funcs := []string{}
+	for name := range fet.funcs {
+		funcs = append(funcs, name)
+	}
+	sort.Strings(funcs)
+	buf, _ := json.Marshal(struct {
+		Config Config
+		Tags   []string
+		Funcs  []string
+	}{conf, tags, funcs})
+	return md5Hex(buf)
+}
+
+func md5Hex(buf []byte) string {
+	sum := md5.Sum(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+// load the manifest of the last compile, return an empty manifest if it's not exist or the config changed
+func (fet *Fet) loadManifest() *compileManifest {
+	manifest := &compileManifest{}
+	if buf, err := ioutil.ReadFile(path.Join(fet.CompileDir, manifestName)); err == nil {
+		if err := json.Unmarshal(buf, manifest); err != nil {
+			fet.debug("read the compile manifest failure:%v", err)
+			manifest = &compileManifest{}
+		}
+	}
+	if manifest.Config != fet.configHash() || manifest.Hashes == nil || manifest.Deps == nil {
+		manifest.Hashes = map[string]string{}
+		manifest.Deps = map[string][]string{}
+	}
+	manifest.hashes = map[string]string{}
+	return manifest
+}
+
+// get the current hash of the source file
+func (fet *Fet) sourceHash(manifest *compileManifest, name string) (string, bool) {
+	if hash, ok := manifest.hashes[name]; ok {
+		return hash, hash != ""
+	}
+	buf, err := fet.loader.ReadFile(name)
+	hash := ""
+	if err == nil {
+		hash = md5Hex(buf)
+	}
+	manifest.hashes[name] = hash
+	return hash, hash != ""
+}
+
+// check if the template and it's dependencies are not changed since the last compile
+func (fet *Fet) isUpToDate(manifest *compileManifest, tpl string) ([]string, bool) {
+	name := fet.loaderName(tpl)
+	relaDeps, ok := manifest.Deps[name]
+	if !ok {
+		return nil, false
+	}
+	if _, err := os.Stat(fet.RealCmplPath(tpl)); err != nil {
+		return nil, false
+	}
+	for _, cur := range append([]string{name}, relaDeps...) {
+		if hash, ok := fet.sourceHash(manifest, cur); !ok || hash != manifest.Hashes[cur] {
+			return nil, false
+		}
+	}
+	deps := []string{}
+	for _, cur := range relaDeps {
+		deps = append(deps, fet.RealTmplPath(cur))
+	}
+	return deps, true
+}
+
+// save the manifest of the compiled and skipped templates,
+// the source hashes checked before compiling are reused
+func (fet *Fet) saveManifest(last *compileManifest, result *CompileResult) error {
+	manifest := &compileManifest{
+		Config: fet.configHash(),
+		Hashes: map[string]string{},
+		Deps:   map[string][]string{},
+		hashes: last.hashes,
+	}
+	for tpl, deps := range result.Deps {
+		name := fet.loaderName(tpl)
+		relaDeps := []string{}
+		for _, dep := range deps {
+			relaDeps = append(relaDeps, fet.loaderName(dep))
+		}
+		isOk := true
+		for _, cur := range append([]string{name}, relaDeps...) {
+			if hash, ok := fet.sourceHash(manifest, cur); ok {
+				manifest.Hashes[cur] = hash
+			} else {
+				isOk = false
+			}
+		}
+		if isOk {
+			manifest.Deps[name] = relaDeps
+		}
+	}
+	buf, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(fet.CompileDir, os.ModePerm); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(fet.CompileDir, manifestName), buf, 0644)
+}
@@ -67,6 +67,7 @@ const (
 	Space              = ' '
 	Bitor              = "bitor"
 	Dollar             = '$'
+	At                 = '@'
 	VarSymbol          = '`'
 )
 
@@ -180,6 +181,22 @@ func getNoSpaceTokens(tokens []AnyToken, num int) (isPrevSpace bool, result []An
 	return
 }
 
+// Error with the rune index of the expression where the error occurs
+type Error struct {
+	Index int
+	Err   error
+}
+
+// Error method for Error
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap method for Error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
 // TokenStat struct
 type TokenStat struct {
 	StartIndex  int
@@ -413,12 +430,27 @@ func (identifier *IdentifierToken) Add(s rune) (ok bool, isComplete bool, retry
 		} else if s == Dollar {
 			err = fmt.Errorf("the $ can only use in identifier head")
 			return
+		} else if isDigit && stat.Values[len(stat.Values)-1] == At {
+			err = fmt.Errorf("the loop property name can not begin with a number")
+			return
 		}
 		stat.Values = append(stat.Values, s)
 		ok = true
 		return
 	}
 	vals := stat.Values
+	if s == At && identifier.IsBegin {
+		// the loop property, e.g. '$item@index'
+		for _, cur := range vals {
+			if cur == At {
+				err = fmt.Errorf("the @ can only use once in identifier")
+				return
+			}
+		}
+		stat.Values = append(stat.Values, s)
+		ok = true
+		return
+	}
 	if len(vals) == 1 && (vals[0] == Underline || vals[0] == Dollar) {
 		err = fmt.Errorf("can not use single %s as identifier", string(vals[0]))
 		return
@@ -432,6 +464,9 @@ func (identifier *IdentifierToken) Validate(tokens []AnyToken) (retryToken AnyTo
 	prev := prevs[0]
 	stat := identifier.Stat
 	ident := string(stat.Values)
+	if stat.Values[len(stat.Values)-1] == At {
+		return nil, fmt.Errorf("missing the loop property name after @")
+	}
 	if op, ok := keywordOperators[ident]; ok {
 		if op == "!" && prev == nil {
 			// "not"
@@ -1595,20 +1630,20 @@ func (exp *Expression) tokenize(context string) (tokens []AnyToken, err error) {
 	for i := 0; i < total; i++ {
 		s := rns[i]
 		if err = parser.Add(s); err != nil {
-			return nil, err
+			return nil, &Error{Index: i, Err: err}
 		}
 	}
 	if parser.RBLevel != 0 {
-		return nil, fmt.Errorf("wrong round bracket")
+		return nil, &Error{Index: total, Err: fmt.Errorf("wrong round bracket")}
 	} else if parser.SBLevel != 0 {
-		return nil, fmt.Errorf("wrong square bracket")
+		return nil, &Error{Index: total, Err: fmt.Errorf("wrong square bracket")}
 	}
 	// check if token is not complete
 	current := parser.Current
 	if current != nil {
 		switch token := current.(type) {
 		case *StringToken:
-			return nil, fmt.Errorf("unclosed string token:%s", string(token.Stat.Values))
+			return nil, &Error{Index: total, Err: fmt.Errorf("unclosed string token:%s", string(token.Stat.Values))}
 		case *SpaceToken:
 			token.IsComplete = true
 			return parser.Tokens, nil
@@ -1617,14 +1652,14 @@ func (exp *Expression) tokenize(context string) (tokens []AnyToken, err error) {
 		}
 	}
 	if err = parser.Add(Space); err != nil {
-		return nil, err
+		return nil, &Error{Index: total, Err: err}
 	}
 	// ignore test space token, because it is not complete
 	lasts := parser.Tokens
 	// use spew.Dump(lasts) or litter.Dump
 	EOF := &EOFToken{}
 	if _, err = EOF.Validate(lasts); err != nil {
-		return nil, err
+		return nil, &Error{Index: total, Err: err}
 	}
 	return lasts, nil
 }
@@ -1655,3 +1690,9 @@ func (exp *Expression) Parse(context string) (*Node, error) {
 	}
 	return lastToken.Node, nil
 }
+
+// IsKeywordOperator check if the name is a keyword operator, e.g. 'and', 'eq'
+func IsKeywordOperator(name string) bool {
+	_, ok := keywordOperators[name]
+	return ok
+}
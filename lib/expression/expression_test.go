@@ -1,6 +1,7 @@
 package expression
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -54,6 +55,11 @@ func TestTokenize(t *testing.T) {
 		assertTokenList(t, "_1", "IdentifierToken")
 		assertTokenList(t, "ID", "IdentifierToken")
 		assertTokenList(t, "i_", "IdentifierToken")
+		assertTokenList(t, "$item@index", "IdentifierToken")
+		assertTokenList(t, "item@first", "IdentifierToken")
+		assertErrorTokenize(t, "$item@")
+		assertErrorTokenize(t, "$item@1")
+		assertErrorTokenize(t, "$item@index@first")
 		// round brackets
 		assertTokenList(t, "(e)", "LeftBracketToken", "IdentifierToken", "RightBracketToken")
 		assertTokenList(t, "((e)+e)", "LeftBracketToken", "LeftBracketToken", "IdentifierToken", "RightBracketToken", "OperatorToken", "IdentifierToken", "RightBracketToken")
@@ -132,3 +138,13 @@ func TestToAst(t *testing.T) {
 		assert.Nil(t, err)
 	})
 }
+
+func TestErrorIndex(t *testing.T) {
+	var expErr *Error
+	_, err := exp.Parse("$a + 'b'")
+	assert.True(t, errors.As(err, &expErr))
+	assert.Equal(t, 5, expErr.Index)
+	_, err = exp.Parse("($a + 1")
+	assert.True(t, errors.As(err, &expErr))
+	assert.Equal(t, 7, expErr.Index)
+}
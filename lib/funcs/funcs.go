@@ -2,6 +2,7 @@ package funcs
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
@@ -33,6 +34,29 @@ type JSON map[string]interface{}
 type LoopChan struct {
 	Chan chan int
 	Loop int
+	// the iterations of the loop, setted when the loop is closed
+	Count int
+	ctx   context.Context
+}
+
+// LoopMeta used for the loop properties, e.g. '$item@index'
+type LoopMeta struct {
+	List      interface{}
+	Index     int
+	Iteration int
+	First     bool
+	Last      bool
+	// the total iterations, -1 if unknown
+	Total int
+}
+
+// Next goto the next iteration
+func (meta *LoopMeta) Next() string {
+	meta.Index++
+	meta.Iteration = meta.Index + 1
+	meta.First = meta.Index == 0
+	meta.Last = meta.Iteration == meta.Total
+	return ""
 }
 
 // CaptureData used for Capture
@@ -49,13 +73,19 @@ func (lc *LoopChan) init() {
 
 // Close close the loop chan
 func (lc *LoopChan) Close() (string, error) {
+	lc.Count = lc.Loop
 	lc.Loop = -1
 	close(lc.Chan)
 	return "", nil
 }
 
-// Next goto the next step
+// Next goto the next step, stop the loop when the context is done
 func (lc *LoopChan) Next() (string, error) {
+	if lc.ctx != nil {
+		if err := lc.ctx.Err(); err != nil {
+			return "", err
+		}
+	}
 	lc.Loop++
 	lc.Chan <- lc.Loop
 	return "", nil
@@ -71,6 +101,49 @@ func All() template.FuncMap {
 	return helpers
 }
 
+// the type of context.Context
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// WithContext returns the funcs which the first parameter is a context.Context, with the ctx bound to it,
+// so they can be called in the templates without the context parameter.
+func WithContext(ctx context.Context, fns template.FuncMap) template.FuncMap {
+	return WithContextFunc(func() context.Context {
+		return ctx
+	}, fns)
+}
+
+// WithContextFunc same as WithContext, but the ctx is got by 'getCtx' when the funcs are called,
+// so the funcs can be bound once and called with the different ctx.
+func WithContextFunc(getCtx func() context.Context, fns template.FuncMap) template.FuncMap {
+	result := template.FuncMap{}
+	for name, fn := range fns {
+		fnValue := reflect.ValueOf(fn)
+		fnType := fnValue.Type()
+		if fnType.Kind() != reflect.Func || fnType.NumIn() == 0 || fnType.In(0) != contextType {
+			continue
+		}
+		in := make([]reflect.Type, fnType.NumIn()-1)
+		for i := range in {
+			in[i] = fnType.In(i + 1)
+		}
+		out := make([]reflect.Type, fnType.NumOut())
+		for i := range out {
+			out[i] = fnType.Out(i)
+		}
+		isVariadic := fnType.IsVariadic()
+		bound := reflect.MakeFunc(reflect.FuncOf(in, out, isVariadic), func(args []reflect.Value) []reflect.Value {
+			ctx := getCtx()
+			args = append([]reflect.Value{reflect.ValueOf(&ctx).Elem()}, args...)
+			if isVariadic {
+				return fnValue.CallSlice(args)
+			}
+			return fnValue.Call(args)
+		})
+		result[name] = bound.Interface()
+	}
+	return result
+}
+
 // Inject funcs
 func Inject() template.FuncMap {
 	injects := template.FuncMap{}
@@ -136,13 +209,15 @@ func Inject() template.FuncMap {
 	})
 	injects["INJECT_TO_FLOAT"] = toFloat
 	injects["INJECT_TO_FORS"] = toFloatOrString
-	injects["INJECT_MAKE_LOOP_CHAN"] = func() (*LoopChan, error) {
-		loopChan := &LoopChan{}
+	injects["INJECT_MAKE_LOOP_CHAN"] = func(ctx context.Context) (*LoopChan, error) {
+		loopChan := &LoopChan{ctx: ctx}
 		loopChan.init()
 		return loopChan, nil
 	}
+	injects["INJECT_LOOP_META"] = loopMeta
 	injects["INJECT_INDEX"] = index
 	injects["INJECT_CAPTURE_SCOPE"] = capture
+	injects["INJECT_FUNC_ARG"] = funcArg
 	return injects
 }
 
@@ -584,6 +659,39 @@ func capture(data interface{}, variables ...interface{}) CaptureData {
 	return result
 }
 
+// get the argument of the template function, or the default value if not passed
+func funcArg(scope CaptureData, name string, defValue interface{}) interface{} {
+	if value, ok := scope.Variables[name]; ok {
+		return value
+	}
+	return defValue
+}
+
+// make the loop properties of the list, without the list the total is unknown
+func loopMeta(lists ...interface{}) *LoopMeta {
+	meta := &LoopMeta{
+		Index: -1,
+		Total: -1,
+	}
+	if len(lists) > 0 {
+		meta.List = lists[0]
+		meta.Total = 0
+		value := reflect.ValueOf(meta.List)
+		for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+			value = value.Elem()
+		}
+		switch value.Kind() {
+		case reflect.Array, reflect.Slice, reflect.Map:
+			meta.Total = value.Len()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			meta.Total = int(math.Max(float64(value.Int()), 0))
+		case reflect.Chan, reflect.Func:
+			meta.Total = -1
+		}
+	}
+	return meta
+}
+
 func now() int64 {
 	t := time.Now()
 	return t.Unix()
@@ -1,6 +1,9 @@
 package funcs
 
 import (
+	"context"
+	"html/template"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -152,3 +155,46 @@ func TestJsonEncode(t *testing.T) {
 	assert.Equal(t, `[1,2,3]`, jsonEncode(a))
 	assert.Equal(t, `"`+s+`"`, jsonEncode(s))
 }
+
+func TestWithContext(t *testing.T) {
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, "fet")
+	fns := WithContext(ctx, template.FuncMap{
+		"value": func(ctx context.Context, suffix ...string) string {
+			return ctx.Value(ctxKey{}).(string) + strings.Join(suffix, "")
+		},
+		"upper": strings.ToUpper,
+	})
+	assert.Equal(t, 1, len(fns))
+	value := fns["value"].(func(...string) string)
+	assert.Equal(t, "fet", value())
+	assert.Equal(t, "fet!", value("!"))
+	// the ctx is got when called
+	fns = WithContextFunc(func() context.Context {
+		return ctx
+	}, template.FuncMap{
+		"value": func(ctx context.Context) string {
+			return ctx.Value(ctxKey{}).(string)
+		},
+	})
+	get := fns["value"].(func() string)
+	assert.Equal(t, "fet", get())
+	ctx = context.WithValue(context.Background(), ctxKey{}, "changed")
+	assert.Equal(t, "changed", get())
+}
+
+func TestLoopMeta(t *testing.T) {
+	meta := loopMeta([]int{1, 2})
+	assert.Equal(t, 2, meta.Total)
+	meta.Next()
+	assert.True(t, meta.First)
+	assert.False(t, meta.Last)
+	meta.Next()
+	assert.Equal(t, 1, meta.Index)
+	assert.Equal(t, 2, meta.Iteration)
+	assert.False(t, meta.First)
+	assert.True(t, meta.Last)
+	assert.Equal(t, 1, loopMeta(&map[string]int{"a": 1}).Total)
+	assert.Equal(t, 0, loopMeta(nil).Total)
+	assert.Equal(t, -1, loopMeta().Total)
+}
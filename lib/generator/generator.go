@@ -1,6 +1,7 @@
 package generator
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -30,8 +31,20 @@ type GenOptions struct {
 type ParseOptions struct {
 	NoObjectIndex bool
 	IsInCapture   bool
+	IsInFunction  bool
 	Conf          *t.FetConfig
 	Captures      *map[string]string
+	// the loop variables and the named loops '$fet.foreach.name', map to the loop properties
+	Loops *map[string]LoopVar
+}
+
+// LoopVar the variable keep the loop properties
+type LoopVar struct {
+	Name string
+	// the total iterations is unknown, e.g. the c-style 'for' loop
+	NoTotal bool
+	// set when the loop properties are used
+	Used *bool
 }
 
 // Generator for parse code
@@ -86,6 +99,14 @@ var (
 		"null":  "nil",
 		"nil":   "nil",
 	}
+	// loopProps the supported loop properties
+	loopProps = map[string]string{
+		"index":     "Index",
+		"iteration": "Iteration",
+		"first":     "First",
+		"last":      "Last",
+		"total":     "Total",
+	}
 	// NoNeedIndexFuncs funcs
 	NoNeedIndexFuncs = map[string]bool{
 		"empty": true,
@@ -138,11 +159,65 @@ const (
 	ExpName
 )
 
+// write the loop property
+func writeLoopProp(str *strings.Builder, loop LoopVar, prop string) error {
+	field, ok := loopProps[prop]
+	if !ok {
+		return fmt.Errorf("unsupported loop property '%s'", prop)
+	}
+	if loop.NoTotal && (prop == "last" || prop == "total") {
+		return fmt.Errorf("the loop property '%s' is not supported in c-style 'for' loop", prop)
+	}
+	if loop.Used != nil {
+		*loop.Used = true
+	}
+	str.WriteString(loop.Name + "." + field)
+	return nil
+}
+
+// get the loop variable by the key
+func getLoopVar(parseOptions *ParseOptions, key string) (loop LoopVar, ok bool) {
+	if parseOptions.Loops != nil && !parseOptions.IsInCapture {
+		loop, ok = (*parseOptions.Loops)[key]
+	}
+	return
+}
+
+// tokenError wrap the error with the rune index of the token in the expression
+func tokenError(stat *e.TokenStat, err error) error {
+	var expErr *e.Error
+	if errors.As(err, &expErr) {
+		return err
+	}
+	return &e.Error{
+		Index: stat.StartIndex,
+		Err:   err,
+	}
+}
+
+// parse the loop property of the loop variable, e.g. '$item@index'
+func (gen *Generator) parseLoopProp(options *GenOptions, parseOptions *ParseOptions, name string, fieldType FieldType) error {
+	index := strings.IndexRune(name, e.At)
+	varName, prop := name[:index], name[index+1:]
+	if fieldType == FuncName {
+		return fmt.Errorf("wrong function name: %s", name)
+	}
+	if isVar, key := options.NsFn(varName); isVar {
+		if loop, ok := getLoopVar(parseOptions, key); ok {
+			return writeLoopProp(options.Str, loop, prop)
+		}
+	}
+	return fmt.Errorf("the variable '%s' is not a loop variable", varName)
+}
+
 // parse identifier
 func (gen *Generator) parseIdentifier(options *GenOptions, parseOptions *ParseOptions, name string, fieldType FieldType) error {
 	nsFn, str := options.NsFn, options.Str
 	conf := gen.Conf
-	isInCapture, parseConf := parseOptions.IsInCapture, parseOptions.Conf
+	isInCapture, isInFunction, parseConf := parseOptions.IsInCapture, parseOptions.IsInFunction, parseOptions.Conf
+	if strings.ContainsRune(name, e.At) {
+		return gen.parseLoopProp(options, parseOptions, name, fieldType)
+	}
 	if val, ok := LiteralSymbols[name]; ok {
 		if fieldType != ExpName {
 			panic(fmt.Sprint("syntax error: unexpect token ", name))
@@ -168,7 +243,12 @@ func (gen *Generator) parseIdentifier(options *GenOptions, parseOptions *ParseOp
 						return fmt.Errorf("wrong identifier name: %s", origName)
 					}
 					if !isInCapture && name == "ROOT" {
-						str.WriteString("$")
+						if isInFunction {
+							// the root data of the function scope
+							str.WriteString("$.Data")
+						} else {
+							str.WriteString("$")
+						}
 						return nil
 					}
 				}
@@ -177,7 +257,11 @@ func (gen *Generator) parseIdentifier(options *GenOptions, parseOptions *ParseOp
 					str.WriteString("Data.")
 				} else if conf.AutoRoot {
 					// trait with root data
-					str.WriteString("$.")
+					if isInFunction {
+						str.WriteString("$.Data.")
+					} else {
+						str.WriteString("$.")
+					}
 				} else {
 					// trait with variables
 					str.WriteString("$")
@@ -222,6 +306,14 @@ func (gen *Generator) parseRecursive(node *Node, options *GenOptions, parseOptio
 					ast, _ := exp.Parse(express)
 					var inner string
 					if inner, noDelimit, err = gen.Build(ast, options, parseOptions); err != nil {
+						var expErr *e.Error
+						if errors.As(err, &expErr) {
+							// the index of the variable in the string
+							err = &e.Error{
+								Index: stat.StartIndex + pos.StartIndex + 1 + expErr.Index,
+								Err:   expErr.Err,
+							}
+						}
 						return noDelimit, err
 					}
 					str.WriteString(inner)
@@ -246,7 +338,7 @@ func (gen *Generator) parseRecursive(node *Node, options *GenOptions, parseOptio
 			if name == "$fet" {
 				str.WriteString(".")
 			} else if err = gen.parseIdentifier(options, parseOptions, name, ExpName); err != nil {
-				return noDelimit, err
+				return noDelimit, tokenError(stat, err)
 			}
 		}
 	} else if curType == "object" {
@@ -321,6 +413,14 @@ func (gen *Generator) parseRecursive(node *Node, options *GenOptions, parseOptio
 							} else {
 								panic("wrong static variable $fet." + first + "." + second)
 							}
+						} else if count == 3 && names[0] == "foreach" {
+							loop, ok := getLoopVar(parseOptions, "$fet.foreach."+names[1])
+							if !ok {
+								return noDelimit, tokenError(t.Stat, fmt.Errorf("undefined loop: $fet.foreach.%s", names[1]))
+							}
+							if err = writeLoopProp(str, loop, names[2]); err != nil {
+								return noDelimit, tokenError(t.Stat, err)
+							}
 						} else {
 							panic("unexpected static variable $fet")
 						}
@@ -328,7 +428,7 @@ func (gen *Generator) parseRecursive(node *Node, options *GenOptions, parseOptio
 				} else {
 					addIndexFn()
 					if err = gen.parseIdentifier(options, parseOptions, string(t.Stat.Values), ObjectRoot); err != nil {
-						return noDelimit, err
+						return noDelimit, tokenError(t.Stat, err)
 					}
 					isParsed = true
 				}
@@ -369,7 +469,7 @@ func (gen *Generator) parseRecursive(node *Node, options *GenOptions, parseOptio
 							str.WriteString("\"")
 						} else {
 							if err = gen.parseIdentifier(options, parseOptions, ident, ObjectField); err != nil {
-								return noDelimit, err
+								return noDelimit, tokenError(t.Stat, err)
 							}
 						}
 					} else {
@@ -399,7 +499,7 @@ func (gen *Generator) parseRecursive(node *Node, options *GenOptions, parseOptio
 			if t, ok := root.Token.(*e.IdentifierToken); ok {
 				name := string(t.Stat.Values)
 				if err = gen.parseIdentifier(options, parseOptions, name, FuncName); err != nil {
-					return noDelimit, err
+					return noDelimit, tokenError(t.Stat, err)
 				}
 				if _, ok := NoNeedIndexFuncs[name]; ok {
 					parseOptions.NoObjectIndex = true
@@ -0,0 +1,153 @@
+package fet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// the errors when the execution exceeds the limits of the config
+var (
+	ErrMaxLoopIterations  = errors.New("the loop exceeds the max iterations")
+	ErrMaxTotalIterations = errors.New("the loops exceed the max total iterations")
+	ErrMaxOutputBytes     = errors.New("the output exceeds the max bytes")
+	ErrMaxIncludeDepth    = errors.New("the include exceeds the max depth")
+)
+
+// the context key of the execution state
+type execStateKey struct{}
+
+// execState keep the counts of one execution
+type execState struct {
+	iterations int
+}
+
+// the comment keeps the include tags in the compiled code, so the include depth can be checked when rendering
+const (
+	includesCommentBegin = "{{/*fet:includes "
+	includesCommentEnd   = "*/}}"
+)
+
+// limitPos is the position of the tag which checks the limits
+type limitPos struct {
+	file   string
+	line   int
+	column int
+	tag    string
+}
+
+func (pos limitPos) error(err error, max int) *Error {
+	return &Error{
+		File:   pos.file,
+		Line:   pos.line,
+		Column: pos.column,
+		Tag:    pos.tag,
+		Cause:  fmt.Errorf("%w:%d", err, max),
+	}
+}
+
+// includeTag is the position of the first include tag of a nested depth
+type includeTag struct {
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+}
+
+// loopLimit count the iterations of a loop
+type loopLimit struct {
+	// the position of the loop tag
+	limitPos
+	fet        *Fet
+	ctx        context.Context
+	state      *execState
+	iterations int
+}
+
+// make a loop limit when the loop begins, the state is shared by all the loops of the execution,
+// returns nil if the ctx can't be done and the loops have no limits, then the iterations are not counted
+func (fet *Fet) newLoopLimit(ctx context.Context, file string, line int, column int, tag string) (*loopLimit, error) {
+	if ctx.Done() == nil && !fet.hasLoopLimits() {
+		return nil, nil
+	}
+	state, _ := ctx.Value(execStateKey{}).(*execState)
+	return &loopLimit{
+		limitPos: limitPos{
+			file:   file,
+			line:   line,
+			column: column,
+			tag:    tag,
+		},
+		fet:   fet,
+		ctx:   ctx,
+		state: state,
+	}, nil
+}
+
+// Step count an iteration of the loop, return an error if the ctx is done or the limits are exceeded
+func (limit *loopLimit) Step() (string, error) {
+	if err := limit.ctx.Err(); err != nil {
+		return "", err
+	}
+	conf := limit.fet.Config
+	limit.iterations++
+	if conf.MaxLoopIterations > 0 && limit.iterations > conf.MaxLoopIterations {
+		return "", limit.error(ErrMaxLoopIterations, conf.MaxLoopIterations)
+	}
+	if limit.state != nil {
+		limit.state.iterations++
+		if conf.MaxTotalIterations > 0 && limit.state.iterations > conf.MaxTotalIterations {
+			return "", limit.error(ErrMaxTotalIterations, conf.MaxTotalIterations)
+		}
+	}
+	return "", nil
+}
+
+// check the nested depth of the include files when rendering,
+// 'tags' are the first include tag of each depth, kept in the compiled code
+func (fet *Fet) checkIncludeDepth(tags []includeTag) error {
+	if max := fet.Config.MaxIncludeDepth; max > 0 && len(tags) > max {
+		tag := tags[max]
+		return limitPos{tag.File, tag.Line, tag.Column, "include"}.error(ErrMaxIncludeDepth, max)
+	}
+	return nil
+}
+
+// add the comment of the include tags after the compiled code
+func wrapIncludeTags(tags []includeTag, code string) string {
+	if len(tags) == 0 {
+		return code
+	}
+	buf, _ := json.Marshal(tags)
+	return code + includesCommentBegin + strings.ReplaceAll(string(buf), "*/", `*\/`) + includesCommentEnd
+}
+
+// get the include tags in the comment of the compiled code
+func parseIncludeTags(code string) []includeTag {
+	var tags []includeTag
+	if index := strings.LastIndex(code, includesCommentBegin); index >= 0 && strings.HasSuffix(code, includesCommentEnd) {
+		_ = json.Unmarshal([]byte(code[index+len(includesCommentBegin):len(code)-len(includesCommentEnd)]), &tags)
+	}
+	return tags
+}
+
+// if need count the iterations of the loops
+func (fet *Fet) hasLoopLimits() bool {
+	return fet.Config.MaxLoopIterations > 0 || fet.Config.MaxTotalIterations > 0
+}
+
+// if need keep the execution state
+func (fet *Fet) hasExecLimits() bool {
+	return fet.hasLoopLimits() || fet.Config.MaxOutputBytes > 0
+}
+
+// the code to make the loop limit before the loop, and the code to count the iterations in the loop,
+// the limits and the ctx are known when rendering, so the step is always added but only called if the limit is made
+func (fet *Fet) compileLoopLimit(node *Node, localNS string) (before string, step string) {
+	name := "$limit_" + indexString(node.StartIndex) + "_" + indexString(node.EndIndex) + localNS
+	lineNo, colNo, _ := node.position(node.StartIndex)
+	before = fet.wrapCode(fmt.Sprintf("%s := (INJECT_LOOP_LIMIT %q %d %d %q)", name, fet.ShortTmplPath(node.Pwd), lineNo, colNo, node.Name))
+	step = fet.wrapCode("if "+name) + fet.wrapCode(name+".Step") + fet.wrapCode("end")
+	return
+}
@@ -0,0 +1,89 @@
+package fet
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/fefit/fet/types"
+)
+
+// Loader for template files
+type Loader = types.Loader
+
+// osLoader load the template files from the disk
+type osLoader struct {
+	dir string
+}
+
+// NewOSLoader create a loader read the template files in directory 'dir'
+func NewOSLoader(dir string) Loader {
+	return &osLoader{
+		dir: dir,
+	}
+}
+
+// the real path of the file on the disk
+func (loader *osLoader) realPath(name string) string {
+	return filepath.Join(loader.dir, filepath.FromSlash(name))
+}
+
+// Stat method for Loader
+func (loader *osLoader) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(loader.realPath(name))
+}
+
+// ReadFile method for Loader
+func (loader *osLoader) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(loader.realPath(name))
+}
+
+// WalkDir method for Loader
+func (loader *osLoader) WalkDir(root string, fn fs.WalkDirFunc) error {
+	return filepath.WalkDir(loader.realPath(root), func(pwd string, d fs.DirEntry, err error) error {
+		name, _ := filepath.Rel(loader.dir, pwd)
+		return fn(filepath.ToSlash(name), d, err)
+	})
+}
+
+// fsLoader load the template files from a file system
+type fsLoader struct {
+	fsys fs.FS
+}
+
+// NewFSLoader create a loader read the template files from 'fsys', e.g. an embed.FS,
+// the root of 'fsys' is treated as the template directory.
+func NewFSLoader(fsys fs.FS) Loader {
+	return &fsLoader{
+		fsys: fsys,
+	}
+}
+
+// Stat method for Loader
+func (loader *fsLoader) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(loader.fsys, name)
+}
+
+// ReadFile method for Loader
+func (loader *fsLoader) ReadFile(name string) ([]byte, error) {
+	return fs.ReadFile(loader.fsys, name)
+}
+
+// WalkDir method for Loader
+func (loader *fsLoader) WalkDir(root string, fn fs.WalkDirFunc) error {
+	return fs.WalkDir(loader.fsys, root, fn)
+}
+
+// the loader name of the template file
+func (fet *Fet) loaderName(tpl string) string {
+	if name, err := filepath.Rel(fet.TemplateDir, tpl); err == nil {
+		return filepath.ToSlash(name)
+	}
+	return filepath.ToSlash(tpl)
+}
+
+// stat the template file by the loader
+func (fet *Fet) statTemplate(tpl string) (fs.FileInfo, error) {
+	return fet.loader.Stat(fet.loaderName(tpl))
+}
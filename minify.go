@@ -0,0 +1,137 @@
+package fet
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	// the spaces to be collapsed
+	spacesRule = regexp.MustCompile(`\s+`)
+	// the html comments, the start tags and the elements which contents are preserved
+	minifyRule = regexp.MustCompile(`(?i)<!--|<(pre|textarea|script)(?:[\s/>]|$)|<[a-z]`)
+	// the conditional comments of IE are kept, e.g. <!--[if IE]>...<![endif]-->, <!--<![endif]-->
+	condCommentRule = regexp.MustCompile(`(?i)<!--(?:\[if\b|<!\[endif\])[\s\S]*?-->`)
+)
+
+// the html state at the end of the text node, it continues in the next text node
+type minifyState struct {
+	// the element which contents are preserved
+	raw string
+	// in the start tag, the spaces between the attributes are collapsed
+	inTag bool
+	// the quote of the attribute value, the contents are preserved
+	quote byte
+}
+
+// minify the text nodes in order, the element may be closed in the later text node
+func minifyNodes(nodes []*Node) {
+	state := &minifyState{}
+	for _, node := range nodes {
+		// the raw text of literal block is kept
+		if node.Type == TextType && !node.Raw {
+			node.Content = minifyHTML(node.Content, state)
+		}
+	}
+}
+
+// minifyHTML collapse the spaces and remove the comments of the html,
+// the state is changed to the html state at the end of the text
+func minifyHTML(text string, state *minifyState) string {
+	result := strings.Builder{}
+	for text != "" {
+		if state.raw != "" {
+			// keep the contents until the element is closed
+			index := strings.Index(strings.ToLower(text), "</"+state.raw)
+			if index < 0 {
+				result.WriteString(text)
+				break
+			}
+			result.WriteString(text[:index])
+			text = text[index:]
+			state.raw = ""
+			continue
+		}
+		if state.quote != 0 {
+			// keep the attribute value until the quote is closed
+			index := strings.IndexByte(text, state.quote)
+			if index < 0 {
+				result.WriteString(text)
+				break
+			}
+			result.WriteString(text[:index+1])
+			text = text[index+1:]
+			state.quote = 0
+			continue
+		}
+		if state.inTag {
+			index := strings.IndexAny(text, `"'>`)
+			if index < 0 {
+				result.WriteString(spacesRule.ReplaceAllString(text, " "))
+				break
+			}
+			result.WriteString(spacesRule.ReplaceAllString(text[:index+1], " "))
+			if text[index] == '>' {
+				state.inTag = false
+			} else {
+				state.quote = text[index]
+			}
+			text = text[index+1:]
+			continue
+		}
+		loc := minifyRule.FindStringSubmatchIndex(text)
+		if loc == nil {
+			result.WriteString(spacesRule.ReplaceAllString(text, " "))
+			break
+		}
+		result.WriteString(spacesRule.ReplaceAllString(text[:loc[0]], " "))
+		if loc[2] >= 0 {
+			// the element with preserved contents
+			state.raw = strings.ToLower(text[loc[2]:loc[3]])
+			result.WriteString(text[loc[0]:loc[3]])
+			text = text[loc[3]:]
+			continue
+		}
+		if text[loc[0]+1] != '!' {
+			// the start tag with attributes
+			state.inTag = true
+			result.WriteString(text[loc[0]:loc[1]])
+			text = text[loc[1]:]
+			continue
+		}
+		end := strings.Index(text[loc[1]:], "-->")
+		if end < 0 {
+			// the comment contains template tags, keep it
+			result.WriteString(text[loc[0]:])
+			break
+		}
+		end += loc[1] + len("-->")
+		if condCommentRule.FindString(text[loc[0]:end]) == text[loc[0]:end] {
+			result.WriteString(text[loc[0]:end])
+			text = text[end:]
+			continue
+		}
+		text = text[end:]
+		if strings.HasSuffix(result.String(), " ") {
+			// the spaces around the removed comment
+			text = strings.TrimLeftFunc(text, unicode.IsSpace)
+		}
+	}
+	return result.String()
+}
+
+// output the conditional comments kept by minify, html/template removes the html comments,
+// the other text is escaped by the escape function
+func (fet *Fet) outputCondComments(text string, escape func(string) string) string {
+	result := strings.Builder{}
+	last := 0
+	for _, loc := range condCommentRule.FindAllStringIndex(text, -1) {
+		result.WriteString(escape(text[last:loc[0]]))
+		result.WriteString(fet.wrapCode("safe " + strconv.Quote(text[loc[0]:loc[1]])))
+		last = loc[1]
+	}
+	result.WriteString(escape(text[last:]))
+	return result.String()
+}
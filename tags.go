@@ -0,0 +1,172 @@
+package fet
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/fefit/fet/lib/generator"
+	"github.com/fefit/fet/types"
+	"github.com/fefit/fet/utils"
+)
+
+// Tag for the custom tags registered by AddTag
+type Tag struct {
+	// if true, the tag need an end tag, e.g. {%cache "key"%}...{%/cache%}
+	Block bool
+	// if true, the content of the tag is an expression like the 'if' tag, instead of properties
+	Expression bool
+	// the property name of the quoted value without a name, e.g. 'key' of {%cache "key"%}
+	DefaultProp string
+	// the property names and if they are required, nil means any properties are allowed
+	Props map[string]bool
+	// compile the tag to html/template code
+	Compile func(ctx *TagContext) (string, error)
+	// compile the end tag of the block tag to html/template code, default is "{{end}}"
+	CompileEnd func(ctx *TagContext) (string, error)
+}
+
+// TagContext for the compile funcs of the custom tag
+type TagContext struct {
+	// the tag name
+	Name string
+	// the template file and the line of the tag
+	File string
+	Line int
+	// the raw content of the tag
+	Content string
+	// the content compiled to html/template pipeline if the tag is an expression tag
+	Expression string
+	// the raw code of the properties
+	RawProps map[string]string
+	// the properties compiled to html/template pipelines, e.g. '$.Name', '"key"'
+	Props map[string]string
+}
+
+// AddTag register a custom tag, the cached templates are cleared since they may use the tag
+func (fet *Fet) AddTag(name string, tag *Tag) error {
+	if !utils.IsIdentifier(name, types.Gofet) {
+		return fmt.Errorf("the tag name '%s' is not a valid identifier", name)
+	}
+	if _, exists := supportTags[name]; exists || name == "literal" {
+		return fmt.Errorf("the tag '%s' is a builtin tag", name)
+	}
+	if tag == nil || tag.Compile == nil {
+		return fmt.Errorf("the tag '%s' doesn't have a compile func", name)
+	}
+	if fet.tags == nil {
+		fet.tags = map[string]*Tag{}
+	}
+	fet.tags[name] = tag
+	fet.ClearCache()
+	return nil
+}
+
+// the type of the builtin tag or the custom tag
+func (fet *Fet) tagType(name string) (Type, bool) {
+	if curType, exists := supportTags[name]; exists {
+		return curType, true
+	}
+	if tag, exists := fet.tags[name]; exists {
+		if tag.Block {
+			return BlockStartType, true
+		}
+		return SingleType, true
+	}
+	return UnknownType, false
+}
+
+// the tags can be used without properties
+func (fet *Fet) isBareTag(name string) bool {
+	if isLoopControlTag(name) || name == "strip" {
+		return true
+	}
+	_, exists := fet.tags[name]
+	return exists
+}
+
+// validate the properties of the custom tag
+func validCustomTag(node *Node, tag *Tag) (errmsg string) {
+	if tag.Expression {
+		if node.Content == "" {
+			return fmt.Sprintf("the tag '%s' does not have an expression", node.Name)
+		}
+		node.Props = &Props{}
+		return errmsg
+	}
+	if node.Content == "" {
+		node.Props = &Props{}
+	} else if errmsg = validIfHasProps(node, tag.DefaultProp, false); errmsg != "" {
+		return errmsg
+	}
+	props := *node.Props
+	if tag.Props != nil {
+		for name := range props {
+			if _, ok := tag.Props[name]; !ok && name != tag.DefaultProp {
+				return fmt.Sprintf("the tag '%s' doesn't support property '%s'", node.Name, name)
+			}
+		}
+		names := []string{}
+		for name, required := range tag.Props {
+			if _, ok := props[name]; required && !ok {
+				names = append(names, name)
+			}
+		}
+		if len(names) > 0 {
+			sort.Strings(names)
+			return fmt.Sprintf("the tag '%s' need property '%s'", node.Name, names[0])
+		}
+	}
+	return errmsg
+}
+
+// compile the custom tag, the 'node' is the tag start node
+func (node *Node) compileCustomTag(tag *Tag, genOptions *generator.GenOptions, parseOptions *generator.ParseOptions, isEnd bool) (string, error) {
+	fet := node.Fet
+	lineNo, _, _ := node.position(node.StartIndex)
+	ctx := &TagContext{
+		Name:     node.Name,
+		File:     node.Pwd,
+		Line:     lineNo,
+		Content:  node.Content,
+		RawProps: map[string]string{},
+		Props:    map[string]string{},
+	}
+	if tag.Expression {
+		ast, expErr := fet.exp.Parse(node.Content)
+		if expErr != nil {
+			return "", node.haltError(expErr, node.ContentIndex)
+		}
+		code, _, err := fet.gen.Build(ast, genOptions, parseOptions)
+		if err != nil {
+			return "", node.haltError(fmt.Errorf("parse the expression error:%w", err), node.ContentIndex)
+		}
+		ctx.Expression = code
+	}
+	for name, prop := range *node.Props {
+		ast, expErr := fet.exp.Parse(prop.Raw)
+		if expErr != nil {
+			return "", node.haltError(expErr, node.codeIndex(prop.Raw))
+		}
+		code, _, err := fet.gen.Build(ast, genOptions, parseOptions)
+		if err != nil {
+			return "", node.haltError(fmt.Errorf("parse the property '%s' error:%w", name, err), node.codeIndex(prop.Raw))
+		}
+		ctx.RawProps[name] = prop.Raw
+		ctx.Props[name] = code
+	}
+	var (
+		result string
+		err    error
+	)
+	if !isEnd {
+		result, err = tag.Compile(ctx)
+	} else if tag.CompileEnd != nil {
+		result, err = tag.CompileEnd(ctx)
+	} else {
+		result = fet.wrapCode("end")
+	}
+	if err != nil {
+		return "", node.halt("%s", err.Error())
+	}
+	return result, nil
+}
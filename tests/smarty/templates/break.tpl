@@ -0,0 +1 @@
+{%foreach $result as $item%}{%if $item == " "%}{%break%}{%/if%}{%$item%}{%/foreach%}
\ No newline at end of file
@@ -0,0 +1 @@
+{%foreach $result as $item%}{%if $item == " "%}{%continue%}{%/if%}{%$item%}{%/foreach%}
\ No newline at end of file
@@ -0,0 +1,2 @@
+{%$_total = count($result)%}
+{%for $i=0, $j = $_total; $i < $j; $i++%}{%if $result[$i] == " "%}{%continue %}{%/if%}{%$result[$i]%}{%/for%}
\ No newline at end of file
@@ -1,5 +1,7 @@
 package types
 
+import "io/fs"
+
 // NamespaceFn for variable
 type NamespaceFn func(name string) (bool, string)
 
@@ -11,18 +13,41 @@ type Indexs struct {
 
 // FetConfig struct
 type FetConfig struct {
-	LeftDelimiter  string
-	RightDelimiter string
-	CommentSymbol  string
-	TemplateDir    string
-	CompileDir     string
-	UcaseField     bool
-	CompileOnline  bool
-	Glob           bool
-	AutoRoot       bool
-	Debug          bool
-	Ignores        []string
-	Mode           Mode
+	LeftDelimiter      string
+	RightDelimiter     string
+	CommentSymbol      string
+	TemplateDir        string
+	CompileDir         string
+	UcaseField         bool
+	CompileOnline      bool
+	Glob               bool
+	AutoRoot           bool
+	Debug              bool
+	CollectErrors      bool
+	Parallel           int
+	Incremental        bool
+	Version            string
+	WatchInterval      int
+	CacheCheckInterval int
+	MaxLoopIterations  int
+	MaxTotalIterations int
+	MaxOutputBytes     int
+	MaxIncludeDepth    int
+	TrimBlocks         bool
+	Minify             bool
+	Ignores            []string
+	Mode               Mode
+	Loader             Loader `json:"-"`
+}
+
+// Loader for template files, the names are slash-separated paths relative to the template directory
+type Loader interface {
+	// Stat returns the info of the file or directory
+	Stat(name string) (fs.FileInfo, error)
+	// ReadFile returns the content of the file
+	ReadFile(name string) ([]byte, error)
+	// WalkDir walks the directory tree rooted at root
+	WalkDir(root string, fn fs.WalkDirFunc) error
 }
 
 // Mode of parse type
@@ -0,0 +1,170 @@
+package fet
+
+import (
+	"context"
+	"io/fs"
+	"path"
+	"sort"
+	"time"
+)
+
+// WatchHandler handle the templates compiled by Watch, 'files' are the compiled files,
+// 'err' is the errors of the templates failed to compile.
+type WatchHandler func(files []string, err error)
+
+// the modify stamp of the watched file
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// get the modify stamps of all the files in the template directory
+func (fet *Fet) snapshot() (map[string]fileStamp, error) {
+	stamps := map[string]fileStamp{}
+	err := fet.loader.WalkDir(".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		stamps[path.Join(fet.TemplateDir, name)] = fileStamp{
+			modTime: info.ModTime(),
+			size:    info.Size(),
+		}
+		return nil
+	})
+	return stamps, err
+}
+
+/**
+ * fet.Watch
+ * ---------------------------
+ * compile all the files, then poll the template directory by the interval of config 'WatchInterval',
+ * when files changed, compile the changed templates and the templates include or extend them.
+ * the 'handler' is called after every compile, the cached templates are cleared when any file compiled,
+ * Watch returns when the ctx is done.
+ * ---------------------------
+ */
+func (fet *Fet) Watch(ctx context.Context, handler WatchHandler) error {
+	stamps, err := fet.snapshot()
+	if err != nil {
+		return err
+	}
+	result, err := fet.CompileAllContext(ctx)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	handler(result.Files, err)
+	// the templates and their dependencies
+	graph := result.Deps
+	interval := time.Duration(fet.Config.WatchInterval) * time.Millisecond
+	if interval <= 0 {
+		interval = defWatchInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		current, err := fet.snapshot()
+		if err != nil {
+			handler(nil, err)
+			continue
+		}
+		changes := []string{}
+		for file, stamp := range current {
+			if last, ok := stamps[file]; !ok || last != stamp {
+				changes = append(changes, file)
+			}
+		}
+		for file := range stamps {
+			if _, ok := current[file]; !ok {
+				changes = append(changes, file)
+			}
+		}
+		stamps = current
+		if len(changes) == 0 {
+			continue
+		}
+		files, err := fet.affectedFiles(graph, changes)
+		if err != nil {
+			handler(nil, err)
+			continue
+		}
+		if len(files) == 0 {
+			continue
+		}
+		compiled, deps, errs := fet.compileFiles(ctx, files)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		compiledFiles := []string{}
+		var compileErrs Errors
+		for index, tpl := range files {
+			if compiled[index] {
+				compiledFiles = append(compiledFiles, tpl)
+				graph[tpl] = deps[index]
+			} else if errs[index] != nil {
+				compileErrs = appendErrors(compileErrs, errs[index])
+				delete(graph, tpl)
+			}
+		}
+		if len(compiledFiles) > 0 {
+			// the cached templates may not check the modify time of the files
+			fet.ClearCache()
+		}
+		if len(compileErrs) > 0 {
+			handler(compiledFiles, compileErrs)
+		} else {
+			handler(compiledFiles, nil)
+		}
+	}
+}
+
+// the templates need compile when the files changed:
+// the changed templates, the templates depend on the changed files and the templates failed to compile last time.
+func (fet *Fet) affectedFiles(graph map[string][]string, changes []string) ([]string, error) {
+	targets, err := fet.dirCompiledFiles(fet.TemplateDir)
+	if err != nil {
+		return nil, err
+	}
+	// the reverse of the dependency graph
+	depends := map[string][]string{}
+	for tpl, deps := range graph {
+		for _, dep := range deps {
+			depends[dep] = append(depends[dep], tpl)
+		}
+	}
+	isTarget := map[string]bool{}
+	for _, tpl := range targets {
+		isTarget[tpl] = true
+	}
+	affected := map[string]bool{}
+	for _, file := range changes {
+		affected[file] = true
+		for _, tpl := range depends[file] {
+			affected[tpl] = true
+		}
+	}
+	for _, tpl := range targets {
+		if _, ok := graph[tpl]; !ok {
+			affected[tpl] = true
+		}
+	}
+	files := []string{}
+	for tpl := range affected {
+		if isTarget[tpl] {
+			files = append(files, tpl)
+		} else {
+			// removed or ignored
+			delete(graph, tpl)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}